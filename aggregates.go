@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// durationStats summarizes the durations, in seconds, of the passing results
+// of a test or package.
+type durationStats struct {
+	runs   int64
+	mean   float64
+	stddev float64
+	min    float64
+	p50    float64
+	p90    float64
+	p99    float64
+	max    float64
+
+	// histogram counts the durations, so that summaries can be merged.
+	histogram durationHistogram
+
+	// approximate is set when the percentiles were estimated from merged
+	// histograms, and noPercentiles when none of the merged summaries had
+	// one.
+	approximate   bool
+	noPercentiles bool
+}
+
+// Duration histograms have histogramBucketsPerDecade logarithmic buckets for
+// every power of ten above histogramMin seconds, so that percentiles
+// estimated from them are within about 6% of the true ones.
+const (
+	histogramMin              = 0.001
+	histogramBucketsPerDecade = 20
+)
+
+// durationHistogram counts durations, in seconds, by logarithmic bucket.
+// Durations below histogramMin all fall in bucket 0.
+type durationHistogram map[int]int64
+
+// histogramBucket returns the bucket of a duration.
+func histogramBucket(d float64) int {
+	if d < histogramMin {
+		return 0
+	}
+	return 1 + int(math.Floor(math.Log10(d/histogramMin)*histogramBucketsPerDecade))
+}
+
+// histogramBucketValue returns the duration a bucket stands for: the
+// geometric middle of its bounds.
+func histogramBucketValue(b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return histogramMin * math.Pow(10, (float64(b-1)+0.5)/histogramBucketsPerDecade)
+}
+
+// add counts the durations of another histogram in h.
+func (h durationHistogram) add(other durationHistogram) {
+	for b, n := range other {
+		h[b] += n
+	}
+}
+
+// percentile estimates the nearest-rank percentile p, between 0 and 1, of
+// the counted durations.
+func (h durationHistogram) percentile(p float64) float64 {
+	var total int64
+	buckets := make([]int, 0, len(h))
+	for b, n := range h {
+		total += n
+		buckets = append(buckets, b)
+	}
+	if total == 0 {
+		return 0
+	}
+	sort.Ints(buckets)
+	rank := int64(math.Ceil(p * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for _, b := range buckets {
+		seen += h[b]
+		if seen >= rank {
+			return histogramBucketValue(b)
+		}
+	}
+	return histogramBucketValue(buckets[len(buckets)-1])
+}
+
+// String returns the histogram as stored: "bucket:count" pairs, separated by
+// commas, in bucket order.
+func (h durationHistogram) String() string {
+	buckets := make([]int, 0, len(h))
+	for b := range h {
+		buckets = append(buckets, b)
+	}
+	sort.Ints(buckets)
+	pairs := make([]string, len(buckets))
+	for i, b := range buckets {
+		pairs[i] = fmt.Sprintf("%d:%d", b, h[b])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// parseHistogram parses a histogram stored by String.
+func parseHistogram(s string) (durationHistogram, error) {
+	h := make(durationHistogram)
+	if s == "" {
+		return h, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.Index(pair, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("bad histogram bucket %q", pair)
+		}
+		b, err := strconv.Atoi(pair[:i])
+		if err != nil {
+			return nil, fmt.Errorf("bad histogram bucket %q", pair)
+		}
+		n, err := strconv.ParseInt(pair[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad histogram bucket %q", pair)
+		}
+		h[b] += n
+	}
+	return h, nil
+}
+
+// percentile returns the nearest-rank percentile p, between 0 and 1, of the
+// given sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// computeDurationStats summarizes the given durations. The slice is sorted in
+// place.
+func computeDurationStats(durations []float64) durationStats {
+	if len(durations) == 0 {
+		return durationStats{}
+	}
+	sort.Float64s(durations)
+
+	var sum float64
+	for _, d := range durations {
+		sum += d
+	}
+	mean := sum / float64(len(durations))
+	var squares float64
+	histogram := make(durationHistogram)
+	for _, d := range durations {
+		squares += (d - mean) * (d - mean)
+		histogram[histogramBucket(d)]++
+	}
+
+	return durationStats{
+		runs:   int64(len(durations)),
+		mean:   mean,
+		stddev: math.Sqrt(squares / float64(len(durations))),
+		min:    durations[0],
+		p50:    percentile(durations, 0.5),
+		p90:    percentile(durations, 0.9),
+		p99:    percentile(durations, 0.99),
+		max:    durations[len(durations)-1],
+
+		histogram: histogram,
+	}
+}
+
+// combineDurationStats merges daily summaries into a summary of the whole
+// period. The count, mean, standard deviation, minimum and maximum are exact.
+// Percentiles of a single day are exact too; over more than one day they are
+// estimated from the merged daily histograms and marked approximate. Days
+// summarized before histograms were stored are left out of the estimate.
+func combineDurationStats(days []durationStats) durationStats {
+	var c durationStats
+	var sum, sumSquares float64
+	var summarized []durationStats
+	histogram := make(durationHistogram)
+	for _, d := range days {
+		if d.runs == 0 {
+			continue
+		}
+		summarized = append(summarized, d)
+		if c.runs == 0 || d.min < c.min {
+			c.min = d.min
+		}
+		n := float64(d.runs)
+		c.runs += d.runs
+		sum += n * d.mean
+		sumSquares += n * (d.stddev*d.stddev + d.mean*d.mean)
+		if d.max > c.max {
+			c.max = d.max
+		}
+		histogram.add(d.histogram)
+	}
+	if c.runs == 0 {
+		return durationStats{}
+	}
+	if len(summarized) == 1 {
+		return summarized[0]
+	}
+	n := float64(c.runs)
+	c.mean = sum / n
+	c.stddev = math.Sqrt(math.Max(0, sumSquares/n-c.mean*c.mean))
+	c.histogram = histogram
+	c.approximate = true
+	if len(histogram) == 0 {
+		c.noPercentiles = true
+		return c
+	}
+	// Estimates can't fall outside the exact extremes.
+	clamp := func(v float64) float64 { return math.Min(c.max, math.Max(c.min, v)) }
+	c.p50 = clamp(histogram.percentile(0.5))
+	c.p90 = clamp(histogram.percentile(0.9))
+	c.p99 = clamp(histogram.percentile(0.99))
+	return c
+}
+
+// aggregateKind returns the kind stored in the durationAggregates table and
+// the table the raw results are read from.
+func aggregateKind(byPackage bool) (kind, source string) {
+	if byPackage {
+		return "package", "packages"
+	}
+	return "test", "tests"
+}
+
+// aggregateKey identifies the results summarized by a row of the
+// durationAggregates table: those of one test or package, in runs of one
+// project and branch that either did or didn't test a pull request. The
+// package of a package is the package itself.
+type aggregateKey struct {
+	project     string
+	branch      string
+	pullRequest bool
+	pkg         string
+	name        string
+}
+
+// aggregateLockTimeout is how long a refresh of the duration summaries waits
+// for another refresh of the same day to finish.
+const aggregateLockTimeout = 30 * time.Second
+
+// refreshDailyAggregates recomputes the stored duration summaries of every test
+// and package for the day containing t. Refreshes of the same day hold a lock
+// while they read and replace its summaries, so that one that read the day
+// before another run was stored can't overwrite the summaries including it.
+func (env *Environment) refreshDailyAggregates(t time.Time) error {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	ctx := context.Background()
+	conn, err := env.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lock := "durationAggregates-" + day.Format("2006-01-02")
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "select get_lock(?, ?);", lock, int(aggregateLockTimeout.Seconds())).Scan(&locked); err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		return fmt.Errorf("timed out waiting for another refresh of the duration summaries of %v", day.Format("2006-01-02"))
+	}
+	defer conn.ExecContext(ctx, "do release_lock(?);", lock)
+
+	for _, byPackage := range []bool{false, true} {
+		kind, source := aggregateKind(byPackage)
+		pkgColumn := "coalesce(s.packageName, '')"
+		if byPackage {
+			pkgColumn = "s.name"
+		}
+		rows, err := conn.QueryContext(ctx, "select coalesce(r.project, ''), coalesce(r.branch, ''), r.pullRequest is not null, "+pkgColumn+", s.name, s.duration from "+source+" s join runs r on r.id = s.runID where s.dateTime >= ? and s.dateTime < ? and s.result='PASSED' and s.name != ?;", day, day.AddDate(0, 0, 1), panicTestName)
+		if err != nil {
+			return err
+		}
+		durations := make(map[aggregateKey][]float64)
+		for rows.Next() {
+			var k aggregateKey
+			var d float64
+			if err := rows.Scan(&k.project, &k.branch, &k.pullRequest, &k.pkg, &k.name, &d); err != nil {
+				rows.Close()
+				return err
+			}
+			durations[k] = append(durations[k], d)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM durationAggregates WHERE day=? AND kind=?", day, kind); err != nil {
+			tx.Rollback()
+			return err
+		}
+		stmt, err := tx.Prepare("INSERT durationAggregates SET day=?,kind=?,project=?,branch=?,pullRequest=?,packageName=?,name=?,runs=?,mean=?,stddev=?,min=?,p50=?,p90=?,p99=?,max=?,histogram=?")
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for k, ds := range durations {
+			s := computeDurationStats(ds)
+			if _, err := stmt.Exec(day, kind, k.project, k.branch, k.pullRequest, k.pkg, k.name, s.runs, s.mean, s.stddev, s.min, s.p50, s.p90, s.p99, s.max, s.histogram.String()); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		stmt.Close()
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// durationStatsColumns are the columns of the tables returned by
+// DurationStats, after those naming the test or package.
+var durationStatsColumns = []string{"runs", "mean", "stddev", "min", "p50", "p90", "p99", "max", "approximate"}
+
+// DurationStats returns a duration summary of each test, or package, over the
+// filter's window. When only the window, package and project are filtered on,
+// the stored daily aggregates are combined, with approximate percentiles;
+// otherwise the raw results are scanned, which gives exact percentiles.
+func (env *Environment) DurationStats(f *queryFilter, byPackage, exact bool) (*table, error) {
+	usesRaw := exact || f.status != "" || f.label != "" || f.since != nil || f.until != nil || f.run != nil
+	kind, source := aggregateKind(byPackage)
+	_, alias, _, groupColumns, pkgColumn := groupedSource(byPackage)
+
+	// Tests are told apart by package as well as name; packages are their own
+	// package.
+	byTest := make(map[testID][]durationStats)
+	var rawByTest map[testID][]float64
+	if usesRaw {
+		cond, args := f.where(alias, pkgColumn)
+		// Only passing results are summarized unless asked otherwise.
+		if f.status == "" {
+			cond += " and " + alias + ".result='PASSED'"
+		}
+		group := "coalesce(" + alias + ".packageName, '')"
+		if byPackage {
+			group = alias + ".name"
+		}
+		rows, err := env.db.Query("select "+group+", "+alias+".name, "+alias+".duration from "+source+" "+alias+" where "+alias+".name != ?"+cond+";", append([]interface{}{panicTestName}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		rawByTest = make(map[testID][]float64)
+		for rows.Next() {
+			var t testID
+			var d float64
+			if err := rows.Scan(&t.pkg, &t.name, &d); err != nil {
+				return nil, err
+			}
+			rawByTest[t] = append(rawByTest[t], d)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		query := "select packageName, name, runs, mean, stddev, min, p50, p90, p99, max, histogram from durationAggregates a where kind = ?"
+		args := []interface{}{kind}
+		if f.window != 0 {
+			query += " and day >= date(date_sub(now(), INTERVAL ? SECOND))"
+			args = append(args, f.window.Seconds())
+		}
+		if f.branch != "" {
+			query += " and branch = ?"
+			args = append(args, f.branch)
+		}
+		af := &queryFilter{pkg: f.pkg, projects: f.projects}
+		cond, filterArgs := af.where("a", "packageName")
+		rows, err := env.db.Query(query+cond+";", append(args, filterArgs...)...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var t testID
+			var s durationStats
+			var histogram sql.NullString
+			if err := rows.Scan(&t.pkg, &t.name, &s.runs, &s.mean, &s.stddev, &s.min, &s.p50, &s.p90, &s.p99, &s.max, &histogram); err != nil {
+				return nil, err
+			}
+			if histogram.Valid {
+				if s.histogram, err = parseHistogram(histogram.String); err != nil {
+					return nil, fmt.Errorf("duration summary of %v: %v", t.name, err)
+				}
+			}
+			byTest[t] = append(byTest[t], s)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var tests []testID
+	stats := make(map[testID]durationStats)
+	for t, ds := range rawByTest {
+		stats[t] = computeDurationStats(ds)
+		tests = append(tests, t)
+	}
+	for t, summaries := range byTest {
+		stats[t] = combineDurationStats(summaries)
+		tests = append(tests, t)
+	}
+	sortTestIDs(tests)
+
+	t := &table{columns: append(groupColumns, durationStatsColumns...)}
+	for _, test := range tests {
+		s := stats[test]
+		row := []interface{}{test.name}
+		if !byPackage {
+			row = []interface{}{test.pkg, test.name}
+		}
+		if s.noPercentiles {
+			row = append(row, s.runs, s.mean, s.stddev, s.min, nil, nil, nil, s.max, s.approximate)
+		} else {
+			row = append(row, s.runs, s.mean, s.stddev, s.min, s.p50, s.p90, s.p99, s.max, s.approximate)
+		}
+		t.rows = append(t.rows, row)
+	}
+	return t, nil
+}
+
+func init() {
+	commands["aggregate"] = aggregateCommand
+}
+
+// aggregateCommand runs the "aggregate" subcommand, which recomputes the daily
+// duration summaries for every day in the given window. Summaries are kept up
+// to date as logs are inserted, so this is only needed for results inserted
+// before the durationAggregates table existed.
+func aggregateCommand(args []string) {
+	fs := flag.NewFlagSet("aggregate", flag.ExitOnError)
+	dbInfoPtr := fs.String("dbinfo", "db-info.txt", "file in which db information is contained")
+	windowPtr := fs.String("window", "7d", "recompute summaries for the days this far back")
+	fs.Parse(args)
+
+	window, err := ParseWindow(*windowPtr)
+	if err != nil {
+		log.Fatal("Error parsing window: ", err)
+	}
+
+	env := openEnvironment(*dbInfoPtr, nil)
+	defer env.db.Close()
+
+	now := time.Now()
+	for day := now.Add(-time.Duration(window)); !day.After(now); day = day.AddDate(0, 0, 1) {
+		if err := env.refreshDailyAggregates(day); err != nil {
+			log.Fatal("Error computing duration summaries: ", err)
+		}
+	}
+	// The loop may step past the start of today without landing on it.
+	if err := env.refreshDailyAggregates(now); err != nil {
+		log.Fatal("Error computing duration summaries: ", err)
+	}
+	fmt.Println("Duration summaries computed successfully.")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestHistogramBucket(t *testing.T) {
+	for _, c := range []struct {
+		d    float64
+		want int
+	}{
+		{0, 0},
+		{0.0009, 0},
+		{0.001, 1},
+		{0.01, 21},
+		{1, 61},
+		{10, 81},
+	} {
+		if got := histogramBucket(c.d); got != c.want {
+			t.Errorf("histogramBucket(%v) = %v, want %v", c.d, got, c.want)
+		}
+	}
+	// Every duration is within half a bucket of the value of its bucket.
+	for _, d := range []float64{0.0015, 0.2, 3.7, 42, 901} {
+		v := histogramBucketValue(histogramBucket(d))
+		if ratio := v / d; ratio < math.Pow(10, -1.0/histogramBucketsPerDecade) || ratio > math.Pow(10, 1.0/histogramBucketsPerDecade) {
+			t.Errorf("bucket value of %v is %v", d, v)
+		}
+	}
+}
+
+func TestHistogramString(t *testing.T) {
+	h := durationHistogram{61: 3, 0: 1, 81: 2}
+	if got, want := h.String(), "0:1,61:3,81:2"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	parsed, err := parseHistogram(h.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, h) {
+		t.Errorf("parseHistogram(%q) = %v, want %v", h.String(), parsed, h)
+	}
+	for _, bad := range []string{"1", "a:1", "1:b"} {
+		if _, err := parseHistogram(bad); err == nil {
+			t.Errorf("parseHistogram(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestComputeDurationStats(t *testing.T) {
+	s := computeDurationStats([]float64{4, 1, 3, 2})
+	if s.runs != 4 || s.mean != 2.5 || s.min != 1 || s.max != 4 || s.p50 != 2 || s.p90 != 4 {
+		t.Errorf("stats = %+v", s)
+	}
+	if want := math.Sqrt(1.25); math.Abs(s.stddev-want) > 1e-9 {
+		t.Errorf("stddev = %v, want %v", s.stddev, want)
+	}
+	if s.approximate {
+		t.Error("stats of raw durations are marked approximate")
+	}
+}
+
+func TestCombineDurationStats(t *testing.T) {
+	// A single day is returned exactly.
+	day := computeDurationStats([]float64{1, 2, 3})
+	if got := combineDurationStats([]durationStats{day, {}}); !reflect.DeepEqual(got, day) {
+		t.Errorf("combining one day = %+v, want %+v", got, day)
+	}
+
+	// Days whose medians are 1 and 10 have an overall median of 10 when
+	// most results are from the second, which averaging the daily medians
+	// wouldn't give.
+	var first, second []float64
+	for i := 0; i < 10; i++ {
+		first = append(first, 1)
+	}
+	for i := 0; i < 90; i++ {
+		second = append(second, 10)
+	}
+	all := computeDurationStats(append(append([]float64{}, first...), second...))
+	c := combineDurationStats([]durationStats{computeDurationStats(first), computeDurationStats(second)})
+	if !c.approximate || c.noPercentiles {
+		t.Errorf("combined stats = %+v, want approximate percentiles", c)
+	}
+	if c.runs != all.runs || math.Abs(c.mean-all.mean) > 1e-9 || math.Abs(c.stddev-all.stddev) > 1e-9 || c.min != all.min || c.max != all.max {
+		t.Errorf("combined stats = %+v, want the exact count, mean, deviation and extremes of %+v", c, all)
+	}
+	for _, p := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"p50", c.p50, all.p50},
+		{"p90", c.p90, all.p90},
+		{"p99", c.p99, all.p99},
+	} {
+		if math.Abs(p.got-p.want)/p.want > 0.06 {
+			t.Errorf("%v = %v, want within 6%% of %v", p.name, p.got, p.want)
+		}
+	}
+
+	// Estimates stay within the exact extremes.
+	if c.p99 > c.max || c.p50 < c.min {
+		t.Errorf("percentiles %v, %v fall outside [%v, %v]", c.p50, c.p99, c.min, c.max)
+	}
+
+	// Days summarized without histograms give no percentiles.
+	noHistogram := durationStats{runs: 2, mean: 1, min: 1, max: 1}
+	if c := combineDurationStats([]durationStats{noHistogram, noHistogram}); !c.noPercentiles {
+		t.Errorf("combined stats = %+v, want no percentiles", c)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxIngestBytes is the largest log, after decompression, accepted by the
+// ingest API.
+const maxIngestBytes = 256 << 20
+
+// ingestSummary counts what was parsed from an ingested log.
+type ingestSummary struct {
+	Packages     int `json:"packages"`
+	Tests        int `json:"tests"`
+	Passed       int `json:"passed"`
+	Failed       int `json:"failed"`
+	Skipped      int `json:"skipped"`
+	Undetermined int `json:"undetermined"`
+	Panics       int `json:"panics"`
+}
+
+// ingestResponse is the body of a successful ingest.
+type ingestResponse struct {
+	RunID        int64         `json:"runID"`
+	CommitHash   string        `json:"commitHash"`
+	Branch       string        `json:"branch,omitempty"`
+	PullRequest  int           `json:"pullRequest,omitempty"`
+	TargetBranch string        `json:"targetBranch,omitempty"`
+	Project      string        `json:"project,omitempty"`
+	DateTime     time.Time     `json:"dateTime"`
+	Labels       []string      `json:"labels"`
+	Summary      ingestSummary `json:"summary"`
+}
+
+// summarizeResult counts the results parsed from a log.
+func summarizeResult(results *Result) ingestSummary {
+	s := ingestSummary{Packages: len(results.packageResults)}
+	for _, t := range results.testResults {
+		if t.name == panicTestName {
+			s.Panics++
+			continue
+		}
+		s.Tests++
+		switch t.result {
+		case PASSED:
+			s.Passed++
+		case FAILED:
+			s.Failed++
+		case SKIPPED:
+			s.Skipped++
+		case UNDETERMINED:
+			s.Undetermined++
+		}
+	}
+	return s
+}
+
+// errIngestTooLarge is returned when a log is larger than maxIngestBytes.
+var errIngestTooLarge = errors.New("log is larger than " + strconv.Itoa(maxIngestBytes>>20) + "MiB")
+
+// limitedReader fails with errIngestTooLarge once more than n bytes are read.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errIngestTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// ingestBody returns the request body, decompressed if it was sent with
+// gzip, either as declared by Content-Encoding or as recognized from its
+// first bytes.
+func ingestBody(r *http.Request) (io.Reader, error) {
+	body := bufio.NewReader(&limitedReader{r: r.Body, n: maxIngestBytes})
+	magic, _ := body.Peek(2)
+	gzipped := r.Header.Get("Content-Encoding") == "gzip" || len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b
+	if !gzipped {
+		return body, nil
+	}
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedReader{r: zr, n: maxIngestBytes}, nil
+}
+
+// handleRuns serves /runs. GET lists runs, and POST inserts the log in the
+// request body as a new run. The query parameters format (text, test2json or
+// junit, default the project's input or text), commit, branch, pr, target,
+// project, time and label (comma separated, and repeatable) describe it, as the equivalent
+// flags do when inserting from the command line. Inserted runs are recorded in the audit
+// log against the request's token.
+func (s *server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET", "POST") {
+		return
+	}
+	if r.Method == "GET" {
+		s.listRuns(w, r)
+		return
+	}
+	q := r.URL.Query()
+	meta := &runMetadata{
+		commitHash:   q.Get("commit"),
+		branch:       q.Get("branch"),
+		targetBranch: q.Get("target"),
+		project:      q.Get("project"),
+		format:       q.Get("format"),
+	}
+	if meta.commitHash != "" {
+		if err := checkCommitHash(meta.commitHash); err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+	token := requestToken(r)
+	if token != nil && !token.allowsProject(meta.project) {
+		writeError(w, http.StatusForbidden, "token %q may not ingest into project %q", token.name, meta.project)
+		return
+	}
+	s.cfg.applyProject(meta)
+	if meta.format == "" {
+		meta.format = textLogFormat
+	}
+	for _, l := range q["label"] {
+		meta.labels = append(meta.labels, parseLabels(l)...)
+	}
+	if pr := q.Get("pr"); pr != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(pr, "#"))
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "bad pull request number %q", pr)
+			return
+		}
+		meta.pullRequest = n
+	}
+	if t := q.Get("time"); t != "" {
+		parsed, err := parseRunTime(t)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		meta.dateTime = parsed
+	}
+
+	body, err := ingestBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "reading gzip body: %v", err)
+		return
+	}
+	results, err := parseLog(body, meta.format, meta)
+	if errors.Is(err, errIngestTooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "%v", err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "parsing %s log: %v", meta.format, err)
+		return
+	}
+	if len(results.testResults) == 0 && len(results.packageResults) == 0 {
+		writeError(w, http.StatusBadRequest, "no test or package results found in %s log", meta.format)
+		return
+	}
+
+	runID, err := s.env.insertResult(results, meta)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if token != nil {
+		// An ingest that can't be audited is undone, so that every run
+		// inserted with a token is accounted for.
+		if err := s.env.recordAudit(token, "ingest", runID, meta.project, r.RemoteAddr); err != nil {
+			if err := s.env.deleteRun(runID, results.dateTime); err != nil {
+				log.Printf("Error deleting run %d after failing to audit it: %v", runID, err)
+			}
+			writeError(w, http.StatusInternalServerError, "recording ingest in audit log: %v", err)
+			return
+		}
+	}
+	w.Header().Set("Location", apiPrefix+"/runs/"+strconv.FormatInt(runID, 10))
+	writeJSON(w, http.StatusCreated, ingestResponse{
+		RunID:        runID,
+		CommitHash:   results.commitHash,
+		Branch:       meta.branch,
+		PullRequest:  meta.pullRequest,
+		TargetBranch: meta.targetBranch,
+		Project:      meta.project,
+		DateTime:     results.dateTime,
+		Labels:       meta.labels,
+		Summary:      summarizeResult(results),
+	})
+}
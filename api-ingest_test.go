@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIngestMalformedLog(t *testing.T) {
+	s := &server{cfg: &Config{}}
+	req := httptest.NewRequest("POST", apiPrefix+"/runs?commit=abc123", strings.NewReader("--- PASS: TestX"))
+	w := httptest.NewRecorder()
+	s.handleRuns(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestIngestOptionAsCommit(t *testing.T) {
+	s := &server{cfg: &Config{}}
+	for _, commit := range []string{"--output=/tmp/x", "HEAD"} {
+		req := httptest.NewRequest("POST", apiPrefix+"/runs?commit="+url.QueryEscape(commit), strings.NewReader("--- PASS: TestX (0.01s)"))
+		w := httptest.NewRecorder()
+		s.handleRuns(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("commit %q: status = %v, want %v", commit, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/marcinja/go-testdb/report"
+)
+
+const (
+	// defaultPageLimit and maxPageLimit are the default and largest number
+	// of items in a page of a list response.
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// page is the body of every list response. Total is the number of items
+// before the page was taken.
+type page struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+}
+
+// pageFromRequest reads the limit and offset query parameters.
+func pageFromRequest(q url.Values) (p page, err error) {
+	p.Limit = defaultPageLimit
+	if s := q.Get("limit"); s != "" {
+		if p.Limit, err = strconv.Atoi(s); err != nil || p.Limit < 1 || p.Limit > maxPageLimit {
+			return p, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+	}
+	if s := q.Get("offset"); s != "" {
+		if p.Offset, err = strconv.Atoi(s); err != nil || p.Offset < 0 {
+			return p, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	return p, nil
+}
+
+// pageBounds reads the limit and offset query parameters and returns the
+// bounds of the page within n items.
+func pageBounds(q url.Values, n int) (p page, start, end int, err error) {
+	if p, err = pageFromRequest(q); err != nil {
+		return p, 0, 0, err
+	}
+	p.Total = n
+	start, end = p.Offset, p.Offset+p.Limit
+	if start > n {
+		start = n
+	}
+	if end > n {
+		end = n
+	}
+	return p, start, end, nil
+}
+
+// writePage writes a page of items, of which there are n in all, as a list
+// response. slice returns the items between start and end. It is for lists
+// computed in full, such as analyses; lists read from the database are paged
+// in SQL by writeQueryPage.
+func writePage(w http.ResponseWriter, r *http.Request, n int, slice func(start, end int) interface{}) {
+	p, start, end, err := pageBounds(r.URL.Query(), n)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	p.Items = slice(start, end)
+	writeCachedJSON(w, r, p)
+}
+
+// writeQueryPage writes a page of the rows of a query as a list response.
+// The page is set as the limit and offset of f before list is called to read
+// its rows, and count returns the number of rows in all.
+func writeQueryPage(w http.ResponseWriter, r *http.Request, f *queryFilter, list func() (*table, error), count func() (int, error)) {
+	p, err := pageFromRequest(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	f.limit, f.offset = p.Limit, p.Offset
+	t, err := list()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if p.Total, err = count(); err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	p.Items = t.objects()
+	writeCachedJSON(w, r, p)
+}
+
+// writeCachedJSON writes v as the JSON body of a successful response, tagged
+// with a hash of the body. A request whose If-None-Match names that tag is
+// answered with 304 Not Modified and no body.
+func writeCachedJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	body = append(body, '\n')
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	// Results change as runs are inserted, so caches must always check.
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(body); err != nil {
+		log.Print("Error writing response: ", err)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header names the given tag.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// queryFilterFromRequest reads the window, package, status, label, since and
+// until query parameters, which narrow results as the flags of the same names
+// do in the query command. Results are limited to the projects the request
+// may read.
+func (s *server) queryFilterFromRequest(r *http.Request) (*queryFilter, error) {
+	q := r.URL.Query()
+	f := &queryFilter{pkg: q.Get("package"), label: q.Get("label"), branch: q.Get("branch")}
+	var err error
+	if f.projects, err = allowedProjects(r); err != nil {
+		return nil, err
+	}
+	if w := q.Get("window"); w != "" {
+		if f.window, err = ParseWindow(w); err != nil {
+			return nil, fmt.Errorf("bad window: %v", err)
+		}
+	}
+	if st := q.Get("status"); st != "" {
+		status, err := ParseStatus(strings.ToUpper(st))
+		if err != nil {
+			return nil, err
+		}
+		f.status = status.String()
+	}
+	if ref := q.Get("since"); ref != "" {
+		if f.since, err = s.refEnvironment(r).resolveRun(ref); err != nil {
+			return nil, err
+		}
+	}
+	if ref := q.Get("until"); ref != "" {
+		if f.until, err = s.refEnvironment(r).resolveRun(ref); err != nil {
+			return nil, err
+		}
+	}
+	switch o := q.Get("order"); o {
+	case "", "time":
+	case "topo":
+		f.topo = true
+	default:
+		return nil, fmt.Errorf("bad order %q, expected time or topo", o)
+	}
+	return f, nil
+}
+
+// errProjectLimited is returned, wrapped, when a token limited to projects
+// asks for an analysis of a project it may not read, or of every project.
+var errProjectLimited = errors.New("limited to projects")
+
+// profileEnvironment returns an environment for the profile named by the
+// profile query parameter, with the window, baseline, project and branch
+// parameters applied. Tokens limited to projects may only analyse one of their
+// projects.
+func (s *server) profileEnvironment(r *http.Request) (*Environment, error) {
+	q := r.URL.Query()
+	name := q.Get("profile")
+	if name == "" {
+		name = defaultProfile
+	}
+	p, err := s.cfg.Profile(name)
+	if err != nil {
+		return nil, err
+	}
+	// The profile is shared between requests, so overrides go on a copy.
+	profile := *p
+	if w := q.Get("window"); w != "" {
+		if profile.Window, err = ParseWindow(w); err != nil {
+			return nil, fmt.Errorf("bad window: %v", err)
+		}
+	}
+	if b := q.Get("baseline"); b != "" {
+		if profile.Baseline, err = ParseWindow(b); err != nil {
+			return nil, fmt.Errorf("bad baseline: %v", err)
+		}
+	}
+	if p := q.Get("project"); p != "" {
+		s.cfg.setProject(&profile, p)
+	}
+	if b := q.Get("branch"); b != "" {
+		profile.Branch = b
+	}
+	if t := requestToken(r); t != nil && len(t.projects) > 0 {
+		if profile.Project == "" {
+			return nil, fmt.Errorf("token %q is %w and may not read analyses of every project", t.name, errProjectLimited)
+		}
+		if !t.allowsProject(profile.Project) {
+			return nil, fmt.Errorf("token %q is %w and may not read project %q", t.name, errProjectLimited, profile.Project)
+		}
+	}
+	return &Environment{db: s.env.db, profile: &profile}, nil
+}
+
+// refEnvironment returns the environment a request's run refs are resolved
+// in, in which branch refs refer to runs of the request's project, if it
+// names one.
+func (s *server) refEnvironment(r *http.Request) *Environment {
+	return &Environment{db: s.env.db, profile: &Profile{Project: r.URL.Query().Get("project")}}
+}
+
+// profileErrorStatus returns the status of a response to a request for
+// which profileEnvironment failed.
+func profileErrorStatus(err error) int {
+	if errors.Is(err, errProjectLimited) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// listRuns serves GET /runs.
+func (s *server) listRuns(w http.ResponseWriter, r *http.Request) {
+	f, err := s.queryFilterFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	writeQueryPage(w, r, f,
+		func() (*table, error) { return s.env.Runs(f) },
+		func() (int, error) { return s.env.RunCount(f) })
+}
+
+// handleRun serves /runs/{ref}, /runs/{ref}/tests and /runs/{ref}/packages,
+// where ref is anything accepted by compare.
+func (s *server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	ref, sub := strings.TrimPrefix(r.URL.Path, apiPrefix+"/runs/"), ""
+	if i := strings.Index(ref, "/"); i >= 0 {
+		ref, sub = ref[:i], ref[i+1:]
+	}
+	run, err := s.refEnvironment(r).resolveRun(ref)
+	if err == nil && !requestMayRead(r, run) {
+		err = fmt.Errorf("%w with ID %v", errNoRun, run.id)
+	}
+	if errors.Is(err, errNoRun) {
+		writeError(w, http.StatusNotFound, "%v", err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	f, err := s.queryFilterFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	f.run = run
+
+	switch sub {
+	case "":
+		t, err := s.env.Runs(&queryFilter{run: run})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		if len(t.rows) == 0 {
+			writeError(w, http.StatusNotFound, "no run with ID %v", run.id)
+			return
+		}
+		writeCachedJSON(w, r, t.objects()[0])
+		return
+	case "tests":
+		writeQueryPage(w, r, f,
+			func() (*table, error) { return s.env.Tests(f) },
+			func() (int, error) { return s.env.TestCount(f) })
+	case "packages":
+		writeQueryPage(w, r, f,
+			func() (*table, error) { return s.env.Packages(f) },
+			func() (int, error) { return s.env.PackageCount(f) })
+	default:
+		writeError(w, http.StatusNotFound, "unknown resource %q", r.URL.Path)
+	}
+}
+
+// handleTest serves /tests/{name}/history. Test names may contain slashes.
+func (s *server) handleTest(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, apiPrefix+"/tests/")
+	if !strings.HasSuffix(name, "/history") || name == "/history" {
+		writeError(w, http.StatusNotFound, "unknown resource %q", r.URL.Path)
+		return
+	}
+	name = strings.TrimSuffix(name, "/history")
+
+	f, err := s.queryFilterFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	writeQueryPage(w, r, f,
+		func() (*table, error) { return s.env.TestHistory(name, f) },
+		func() (int, error) { return s.env.TestHistoryCount(name, f) })
+}
+
+// handleClusters serves /clusters: the failures within the profile's window,
+// grouped by signature.
+func (s *server) handleClusters(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	q := r.URL.Query()
+	env, err := s.profileEnvironment(r)
+	if err != nil {
+		writeError(w, profileErrorStatus(err), "%v", err)
+		return
+	}
+	failures, err := env.reportFailures()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	matching := []*report.Failure{}
+	for _, f := range failures {
+		if pkg := q.Get("package"); pkg == "" || matchPackage(pkg, f.Package) {
+			matching = append(matching, f)
+		}
+	}
+	clusters := clusterFailures(matching)
+	if clusters == nil {
+		clusters = []*report.FailureCluster{}
+	}
+	writePage(w, r, len(clusters), func(start, end int) interface{} { return clusters[start:end] })
+}
+
+// handleFlaky serves /flaky: tests that both passed and failed on the same
+// commit within the profile's window, most flaky first.
+func (s *server) handleFlaky(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	q := r.URL.Query()
+	env, err := s.profileEnvironment(r)
+	if err != nil {
+		writeError(w, profileErrorStatus(err), "%v", err)
+		return
+	}
+	flaky, err := env.flakyTestsBetween(env.profile.Window, 0)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	matching := []*report.FlakyTest{}
+	for _, f := range flaky {
+		if pkg := q.Get("package"); pkg == "" || matchPackage(pkg, f.Package) {
+			matching = append(matching, f)
+		}
+	}
+	writePage(w, r, len(matching), func(start, end int) interface{} { return matching[start:end] })
+}
+
+// handlePerfDiffs serves /perf-diffs: the performance changes of the most
+// recent commit from the profile's baseline.
+func (s *server) handlePerfDiffs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	q := r.URL.Query()
+	env, err := s.profileEnvironment(r)
+	if err != nil {
+		writeError(w, profileErrorStatus(err), "%v", err)
+		return
+	}
+	diffs, err := env.reportPerfDiffs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	matching := []*report.PerfChange{}
+	for _, d := range diffs {
+		if pkg := q.Get("package"); pkg == "" || matchPackage(pkg, d.Package) {
+			matching = append(matching, d)
+		}
+	}
+	writePage(w, r, len(matching), func(start, end int) interface{} { return matching[start:end] })
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteQueryPage(t *testing.T) {
+	f := &queryFilter{}
+	req := httptest.NewRequest("GET", apiPrefix+"/runs?limit=2&offset=4", nil)
+	w := httptest.NewRecorder()
+	writeQueryPage(w, req, f,
+		func() (*table, error) {
+			if f.limit != 2 || f.offset != 4 {
+				t.Errorf("listed with limit %d and offset %d, want 2 and 4", f.limit, f.offset)
+			}
+			return &table{columns: []string{"runID"}, rows: [][]interface{}{{int64(5)}, {int64(6)}}}, nil
+		},
+		func() (int, error) { return 7, nil })
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+	}
+	var p struct {
+		Items  []map[string]int64 `json:"items"`
+		Total  int                `json:"total"`
+		Offset int                `json:"offset"`
+		Limit  int                `json:"limit"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Items) != 2 || p.Items[0]["runID"] != 5 || p.Total != 7 || p.Offset != 4 || p.Limit != 2 {
+		t.Errorf("page = %+v, want runs 5 and 6 of 7", p)
+	}
+
+	for _, query := range []string{"limit=0", "limit=1001", "offset=-1", "limit=x"} {
+		req := httptest.NewRequest("GET", apiPrefix+"/runs?"+query, nil)
+		w := httptest.NewRecorder()
+		writeQueryPage(w, req, &queryFilter{},
+			func() (*table, error) { t.Errorf("%s: listed rows of a bad page", query); return &table{}, nil },
+			func() (int, error) { return 0, nil })
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %v, want %v", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
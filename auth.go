@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Token scopes. An admin token may do anything.
+const (
+	scopeIngest = "ingest"
+	scopeRead   = "read"
+	scopeAdmin  = "admin"
+)
+
+// tokenScopes are the valid token scopes.
+var tokenScopes = []string{scopeIngest, scopeRead, scopeAdmin}
+
+// tokenPrefix begins every token secret, so that leaked tokens are easy to
+// recognize.
+const tokenPrefix = "tdb_"
+
+// apiToken is a stored API token. Only a hash of its secret is stored.
+type apiToken struct {
+	id     int64
+	name   string
+	scopes []string
+
+	// projects are the projects the token may ingest into and read from.
+	// A token with no projects may use every project.
+	projects []string
+}
+
+// allows reports whether the token has the given scope.
+func (t *apiToken) allows(scope string) bool {
+	for _, s := range t.scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsProject reports whether the token may use the given project.
+func (t *apiToken) allowsProject(project string) bool {
+	if len(t.projects) == 0 {
+		return true
+	}
+	for _, p := range t.projects {
+		if p == project {
+			return true
+		}
+	}
+	return false
+}
+
+// errNoToken is returned when a secret doesn't match a current token.
+var errNoToken = errors.New("invalid or revoked token")
+
+// hashToken returns the hash a token secret is stored as. Secrets are long
+// and random, so a fast hash is enough.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// createToken stores a new token and returns its ID and secret. The secret
+// can't be recovered later.
+func (env *Environment) createToken(name string, scopes, projects []string) (int64, string, error) {
+	if name == "" {
+		return 0, "", errors.New("a token needs a name")
+	}
+	// Tokens are revoked by ID or name, so a name mustn't look like an ID.
+	if _, err := strconv.ParseInt(name, 10, 64); err == nil {
+		return 0, "", fmt.Errorf("token name %q is a number, which would be taken for an ID", name)
+	}
+	if len(scopes) == 0 {
+		return 0, "", fmt.Errorf("a token needs at least one scope of %v", strings.Join(tokenScopes, ", "))
+	}
+	for _, s := range scopes {
+		if !containsString(tokenScopes, s) {
+			return 0, "", fmt.Errorf("unknown scope %q, expected one of %v", s, strings.Join(tokenScopes, ", "))
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return 0, "", err
+	}
+	secret := tokenPrefix + hex.EncodeToString(b)
+	res, err := env.db.Exec("INSERT apiTokens SET name=?,tokenHash=?,scopes=?,projects=?,createdAt=?",
+		name, hashToken(secret), strings.Join(scopes, ","), strings.Join(projects, ","), time.Now())
+	if err != nil {
+		return 0, "", err
+	}
+	id, err := res.LastInsertId()
+	return id, secret, err
+}
+
+// revokeToken revokes the current token with the given ID or, if no current
+// token has that ID, the given name. A name shared by several current tokens
+// is refused, so that they are revoked one at a time by ID.
+func (env *Environment) revokeToken(ref string) error {
+	var ids []int64
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		var found int64
+		err := env.db.QueryRow("select id from apiTokens where id = ? and revokedAt is null;", id).Scan(&found)
+		if err == nil {
+			ids = append(ids, found)
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+	}
+	if len(ids) == 0 {
+		rows, err := env.db.Query("select id from apiTokens where name = ? and revokedAt is null order by id;", ref)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	switch {
+	case len(ids) == 0:
+		return fmt.Errorf("no current token with ID or name %q", ref)
+	case len(ids) > 1:
+		return fmt.Errorf("%d current tokens are named %q, with IDs %v; revoke them by ID", len(ids), ref, ids)
+	}
+
+	res, err := env.db.Exec("UPDATE apiTokens SET revokedAt=? WHERE id=? AND revokedAt IS NULL", time.Now(), ids[0])
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("token %d was revoked meanwhile", ids[0])
+	}
+	return nil
+}
+
+// tokenBySecret returns the current token with the given secret, or
+// errNoToken.
+func (env *Environment) tokenBySecret(secret string) (*apiToken, error) {
+	var (
+		t                apiToken
+		scopes, projects string
+	)
+	err := env.db.QueryRow("select id, name, scopes, projects from apiTokens where tokenHash = ? and revokedAt is null;", hashToken(secret)).Scan(&t.id, &t.name, &scopes, &projects)
+	if err == sql.ErrNoRows {
+		return nil, errNoToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.scopes = parseLabels(scopes)
+	t.projects = parseLabels(projects)
+	return &t, nil
+}
+
+// Tokens returns every token, without secrets, oldest first.
+func (env *Environment) Tokens() (*table, error) {
+	return env.queryTable(
+		[]string{"id", "name", "scopes", "projects", "createdAt", "revoked"},
+		func() []interface{} {
+			return []interface{}{new(int64), new(string), new(string), new(string), new(time.Time), new(string)}
+		},
+		"select id, name, scopes, projects, createdAt, if(revokedAt is null, '', 'revoked') from apiTokens order by id;",
+	)
+}
+
+// recordAudit records that the token performed action on the given run.
+func (env *Environment) recordAudit(t *apiToken, action string, runID int64, project, remoteAddr string) error {
+	_, err := env.db.Exec("INSERT auditLog SET tokenID=?,action=?,runID=?,project=?,remoteAddr=?,at=?", t.id, action, runID, project, remoteAddr, time.Now())
+	return err
+}
+
+// AuditLog returns the audit log with the name of each token, newest first.
+// Only the limit and offset of f apply.
+func (env *Environment) AuditLog(f *queryFilter) (*table, error) {
+	page, pageArgs := f.page()
+	return env.queryTable(
+		[]string{"at", "tokenID", "token", "action", "runID", "project", "remoteAddr"},
+		func() []interface{} {
+			return []interface{}{new(time.Time), new(int64), new(string), new(string), new(int64), new(string), new(string)}
+		},
+		"select a.at, a.tokenID, coalesce(t.name, ''), a.action, a.runID, a.project, a.remoteAddr from auditLog a left join apiTokens t on t.id = a.tokenID order by a.at desc, a.id desc"+page+";",
+		pageArgs...,
+	)
+}
+
+// AuditLogCount returns the number of entries in the audit log.
+func (env *Environment) AuditLogCount() (int, error) {
+	return env.count("select count(*) from auditLog;")
+}
+
+// containsString reports whether values contains s.
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenContextKey is the request context key of the authenticated token.
+type tokenContextKey struct{}
+
+// requestToken returns the token a request was authenticated with, or nil
+// when the server doesn't require tokens.
+func requestToken(r *http.Request) *apiToken {
+	t, _ := r.Context().Value(tokenContextKey{}).(*apiToken)
+	return t
+}
+
+// requestSecret returns the token secret sent with a request, either as a
+// bearer token or, so that browsers can log in to the dashboard, as the
+// password of basic authentication.
+func requestSecret(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+// authenticate checks the token sent with a request, and that it has the
+// scope the request needs: ingest to POST, and read otherwise. It writes an
+// error response and returns nil if the request may not proceed.
+func (s *server) authenticate(w http.ResponseWriter, r *http.Request) *http.Request {
+	api := strings.HasPrefix(r.URL.Path, apiPrefix+"/")
+	fail := func(status int, format string, args ...interface{}) {
+		if !api {
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Basic realm="go-testdb"`)
+			}
+			renderErrorPage(w, status, format, args...)
+			return
+		}
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-testdb"`)
+		}
+		writeError(w, status, format, args...)
+	}
+
+	secret := requestSecret(r)
+	if secret == "" {
+		fail(http.StatusUnauthorized, "an API token is required")
+		return nil
+	}
+	t, err := s.env.tokenBySecret(secret)
+	if err == errNoToken {
+		fail(http.StatusUnauthorized, "%v", err)
+		return nil
+	}
+	if err != nil {
+		log.Print("Error checking token: ", err)
+		fail(http.StatusInternalServerError, "error checking token")
+		return nil
+	}
+	scope := scopeRead
+	if r.Method == "POST" {
+		scope = scopeIngest
+	}
+	if !t.allows(scope) {
+		fail(http.StatusForbidden, "token %q does not have the %v scope", t.name, scope)
+		return nil
+	}
+	return r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, t))
+}
+
+// allowedProjects returns the projects a request may read, given the project
+// query parameter and the request's token: nil for every project, or an error
+// if the token may not read the project asked for.
+func allowedProjects(r *http.Request) ([]string, error) {
+	t := requestToken(r)
+	project := r.URL.Query().Get("project")
+	if project != "" {
+		if t != nil && !t.allowsProject(project) {
+			return nil, fmt.Errorf("token %q may not read project %q", t.name, project)
+		}
+		return []string{project}, nil
+	}
+	if t == nil || len(t.projects) == 0 {
+		return nil, nil
+	}
+	return t.projects, nil
+}
+
+// requestMayRead reports whether the request's token may read the given run.
+// Runs that may not be read are reported as missing.
+func requestMayRead(r *http.Request, run *run) bool {
+	t := requestToken(r)
+	return t == nil || t.allowsProject(run.project)
+}
+
+// handleAudit serves /audit: the audit log of ingested runs, newest first,
+// to admin tokens.
+func (s *server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	if t := requestToken(r); t != nil && !t.allows(scopeAdmin) {
+		writeError(w, http.StatusForbidden, "token %q does not have the %v scope", t.name, scopeAdmin)
+		return
+	}
+	f := &queryFilter{}
+	writeQueryPage(w, r, f,
+		func() (*table, error) { return s.env.AuditLog(f) },
+		s.env.AuditLogCount)
+}
+
+func init() {
+	commands["token"] = tokenCommand
+}
+
+// tokenCommand runs the "token" subcommand family: create, revoke and list.
+func tokenCommand(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s token <create|revoke|list> [flags] [id or name]\n", os.Args[0])
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	sub := args[0]
+
+	fs := flag.NewFlagSet("token "+sub, flag.ExitOnError)
+	dbInfoPtr := fs.String("dbinfo", "db-info.txt", "file in which db information is contained")
+	namePtr := fs.String("name", "", "name of the new token, e.g. the CI job using it")
+	scopesPtr := fs.String("scopes", "", "comma separated scopes of the new token: ingest, read and admin")
+	projectsPtr := fs.String("projects", "", "comma separated projects the new token is limited to (default all)")
+	formatPtr := fs.String("format", "table", "output format of list: table, csv or json")
+	fs.Parse(args[1:])
+
+	env := openEnvironment(*dbInfoPtr, nil)
+	defer env.db.Close()
+
+	switch sub {
+	case "create":
+		id, secret, err := env.createToken(*namePtr, parseLabels(*scopesPtr), parseLabels(*projectsPtr))
+		if err != nil {
+			log.Fatal("Error creating token: ", err)
+		}
+		fmt.Fprintf(os.Stderr, "Created token %d. Its secret is shown only once:\n", id)
+		fmt.Println(secret)
+	case "revoke":
+		if fs.NArg() != 1 {
+			usage()
+		}
+		if err := env.revokeToken(fs.Arg(0)); err != nil {
+			log.Fatal("Error revoking token: ", err)
+		}
+	case "list":
+		t, err := env.Tokens()
+		if err != nil {
+			log.Fatal("Error selecting tokens: ", err)
+		}
+		if err := t.write(os.Stdout, *formatPtr); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"log"
+)
+
+// commands maps subcommand names to the functions that run them. Each
+// function is given the arguments following the subcommand name.
+var commands = map[string]func(args []string){}
+
+// profileFlags holds the flags shared by every command that selects a report
+// profile.
+type profileFlags struct {
+	config          *string
+	profile         *string
+	window          *string
+	baseline        *string
+	perfRatio       *float64
+	perfMinDelta    *float64
+	perfMinDuration *float64
+	skipRateJump    *float64
+	textTemplate    *string
+	htmlTemplate    *string
+
+	// fs is the flag set the flags are registered on, so that load can tell
+	// which were given.
+	fs *flag.FlagSet
+
+	// cfg is the config read by load.
+	cfg *Config
+}
+
+// addProfileFlags registers the profile flags on the given flag set.
+func addProfileFlags(fs *flag.FlagSet) *profileFlags {
+	return &profileFlags{
+		config:          fs.String("config", "", "JSON file containing report profiles and project settings"),
+		profile:         fs.String("profile", defaultProfile, "report profile to use, e.g. daily, weekly or release"),
+		window:          fs.String("window", "", "override the profile's window for failures and panics, e.g. 3d"),
+		baseline:        fs.String("baseline", "", "override the profile's baseline window for performance changes, e.g. 2w"),
+		perfRatio:       fs.Float64("perfRatio", 0, "override the profile's relative performance change threshold, e.g. 0.2"),
+		perfMinDelta:    fs.Float64("perfMinDelta", 0, "override the profile's minimum performance change in seconds"),
+		perfMinDuration: fs.Float64("perfMinDuration", 0, "override the profile's minimum test duration in seconds"),
+		skipRateJump:    fs.Float64("skipRateJump", 0, "override the profile's skip rate increase threshold, e.g. 0.5"),
+		textTemplate:    fs.String("textTemplate", "", "text/template file defining the update's \"subject\" and \"body\""),
+		htmlTemplate:    fs.String("htmlTemplate", "", "html/template file laying out the HTML update"),
+		fs:              fs,
+	}
+}
+
+// load reads the config file and returns the selected profile with any
+// overrides given on the command line applied.
+func (pf *profileFlags) load() *Profile {
+	cfg, err := LoadConfig(*pf.config)
+	if err != nil {
+		log.Fatal("Error loading config: ", err)
+	}
+	pf.cfg = cfg
+	profile, err := cfg.Profile(*pf.profile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Only flags that were given override the profile, so that a
+	// threshold can be overridden to 0.
+	set := make(map[string]bool)
+	pf.fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["window"] {
+		if profile.Window, err = ParseWindow(*pf.window); err != nil {
+			log.Fatal("Error parsing window: ", err)
+		}
+	}
+	if set["baseline"] {
+		if profile.Baseline, err = ParseWindow(*pf.baseline); err != nil {
+			log.Fatal("Error parsing baseline: ", err)
+		}
+	}
+	if set["perfRatio"] {
+		profile.PerfChangeRatio = *pf.perfRatio
+	}
+	if set["perfMinDelta"] {
+		profile.PerfMinDelta = *pf.perfMinDelta
+	}
+	if set["perfMinDuration"] {
+		profile.PerfMinDuration = *pf.perfMinDuration
+	}
+	if set["skipRateJump"] {
+		profile.SkipRateJump = *pf.skipRateJump
+	}
+	if set["textTemplate"] {
+		profile.TextTemplate = *pf.textTemplate
+	}
+	if set["htmlTemplate"] {
+		profile.HTMLTemplate = *pf.htmlTemplate
+	}
+	return profile
+}
+
+// runMetadataFlags holds the flags shared by every command that inserts runs.
+type runMetadataFlags struct {
+	label   *string
+	input   *string
+	commit  *string
+	branch  *string
+	pr      *int
+	target  *string
+	project *string
+	time    *string
+	owners  *string
+	repo    *string
+}
+
+// addRunMetadataFlags registers the run metadata flags on the given flag set.
+func addRunMetadataFlags(fs *flag.FlagSet) *runMetadataFlags {
+	return &runMetadataFlags{
+		label:   fs.String("label", "", "comma separated labels to attach to inserted runs, e.g. nightly,race"),
+		input:   fs.String("input", "", "format of inserted logs: text, test2json or junit (default from the file extension)"),
+		commit:  fs.String("commit", "", "commit hash of inserted runs, replacing the one in the log"),
+		branch:  fs.String("branch", "", "branch that inserted runs tested"),
+		pr:      fs.Int("pr", 0, "number of the pull request that inserted runs tested"),
+		target:  fs.String("target", "", "branch the pull request of inserted runs targets, e.g. master"),
+		project: fs.String("project", "", "project that inserted runs belong to"),
+		time:    fs.String("time", "", "date time of inserted runs, as 2006-01-02-15:04:05 or RFC 3339, replacing the one in the log"),
+		owners:  fs.String("owners", "", "CODEOWNERS file, or checkout containing one, used to record the owners of inserted runs' packages"),
+		repo:    fs.String("repo", "", "git checkout to read the author, date, subject, parents and changed files of inserted runs' commits from"),
+	}
+}
+
+// load returns the run metadata given by the flags.
+func (mf *runMetadataFlags) load() *runMetadata {
+	meta := &runMetadata{
+		labels:       parseLabels(*mf.label),
+		commitHash:   *mf.commit,
+		branch:       *mf.branch,
+		pullRequest:  *mf.pr,
+		targetBranch: *mf.target,
+		project:      *mf.project,
+		format:       *mf.input,
+		repo:         *mf.repo,
+	}
+	if meta.pullRequest < 0 {
+		log.Fatal("Pull request numbers can't be negative")
+	}
+	if meta.commitHash != "" {
+		if err := checkCommitHash(meta.commitHash); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *mf.time != "" {
+		t, err := parseRunTime(*mf.time)
+		if err != nil {
+			log.Fatal(err)
+		}
+		meta.dateTime = t
+	}
+	if *mf.owners != "" {
+		owners, err := loadOwners(*mf.owners)
+		if err != nil {
+			log.Fatal("Error loading owners: ", err)
+		}
+		meta.owners = owners
+	}
+	return meta
+}
+
+// openEnvironment connects to the database described in the given db info file
+// and returns an environment using the given profile.
+func openEnvironment(dbInfoFile string, profile *Profile) *Environment {
+	dbInfo := ReadFile(dbInfoFile)[0]
+	db, err := sql.Open("mysql",
+		dbInfo)
+	if err != nil {
+		panic(err)
+	}
+	return &Environment{
+		db:      db,
+		profile: profile,
+	}
+}
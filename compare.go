@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RunInfo describes one side of a comparison.
+type RunInfo struct {
+	ID         int64     `json:"id"`
+	CommitHash string    `json:"commitHash"`
+	DateTime   time.Time `json:"dateTime"`
+	Panics     int       `json:"panics"`
+}
+
+// DurationDelta is the change in duration, in seconds, of a test or package
+// between two runs.
+type DurationDelta struct {
+	Name  string  `json:"name"`
+	Base  float64 `json:"base"`
+	Head  float64 `json:"head"`
+	Delta float64 `json:"delta"`
+}
+
+// Comparison describes how the results of a head run differ from those of a
+// base run.
+type Comparison struct {
+	Base RunInfo `json:"base"`
+	Head RunInfo `json:"head"`
+
+	NewFailures       []string `json:"newFailures"`
+	Fixed             []string `json:"fixed"`
+	Added             []string `json:"added"`
+	Removed           []string `json:"removed"`
+	NewlySkipped      []string `json:"newlySkipped"`
+	NewlyUndetermined []string `json:"newlyUndetermined"`
+
+	TestDurations    []DurationDelta `json:"testDurations"`
+	PackageDurations []DurationDelta `json:"packageDurations"`
+}
+
+func init() {
+	commands["compare"] = compareCommand
+}
+
+// compareCommand runs the "compare" subcommand, which compares two runs given
+// as run IDs or commits.
+func compareCommand(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	dbInfoPtr := fs.String("dbinfo", "db-info.txt", "file in which db information is contained")
+	formatPtr := fs.String("format", "text", "output format: text, markdown or json")
+	outPtr := fs.String("o", "", "file to write the comparison to instead of stdout")
+	projectPtr := fs.String("project", "", "project whose runs branch refs refer to")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compare [flags] <base> <head>\n\nA ref may be a run ID, a commit hash, run:<id>, commit:<hash> or branch:<name>.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	env := openEnvironment(*dbInfoPtr, &Profile{Project: *projectPtr})
+	defer env.db.Close()
+
+	c, err := env.Compare(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		log.Fatal("Error comparing runs: ", err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *outPtr != "" {
+		f, err := os.Create(*outPtr)
+		if err != nil {
+			log.Fatal("Error creating file for comparison: ", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch *formatPtr {
+	case "text":
+		err = c.WriteText(w)
+	case "markdown", "md":
+		err = c.WriteMarkdown(w)
+	case "json":
+		err = c.WriteJSON(w)
+	default:
+		log.Fatalf("Unknown format %q", *formatPtr)
+	}
+	if err != nil {
+		log.Fatal("Error writing comparison: ", err)
+	}
+}
+
+// Compare resolves the base and head refs to runs and compares their results.
+func (env *Environment) Compare(baseRef, headRef string) (*Comparison, error) {
+	base, err := env.resolveRun(baseRef)
+	if err != nil {
+		return nil, err
+	}
+	head, err := env.resolveRun(headRef)
+	if err != nil {
+		return nil, err
+	}
+
+	baseTests, err := env.runTestResults(base.id)
+	if err != nil {
+		return nil, err
+	}
+	headTests, err := env.runTestResults(head.id)
+	if err != nil {
+		return nil, err
+	}
+	basePackages, err := env.runPackageResults(base.id)
+	if err != nil {
+		return nil, err
+	}
+	headPackages, err := env.runPackageResults(head.id)
+	if err != nil {
+		return nil, err
+	}
+
+	c := compareResults(baseTests, headTests, basePackages, headPackages)
+	c.Base = RunInfo{ID: base.id, CommitHash: base.commitHash, DateTime: base.dateTime, Panics: countPanics(baseTests)}
+	c.Head = RunInfo{ID: head.id, CommitHash: head.commitHash, DateTime: head.dateTime, Panics: countPanics(headTests)}
+	return c, nil
+}
+
+// countPanics returns the number of panics recorded among the given results.
+func countPanics(results []*TestResult) int {
+	var n int
+	for _, t := range results {
+		if t.name == panicTestName {
+			n++
+		}
+	}
+	return n
+}
+
+// compareResults compares the results of two runs. Panics are not tests and
+// are left out of the comparison.
+func compareResults(baseTests, headTests []*TestResult, basePackages, headPackages []*PackageResult) *Comparison {
+	byName := func(results []*TestResult) map[string]*TestResult {
+		m := make(map[string]*TestResult)
+		for _, t := range results {
+			if t.name != panicTestName {
+				m[t.name] = t
+			}
+		}
+		return m
+	}
+	baseByName := byName(baseTests)
+	headByName := byName(headTests)
+
+	c := &Comparison{}
+	for name, h := range headByName {
+		b, ok := baseByName[name]
+		if !ok {
+			c.Added = append(c.Added, name)
+			continue
+		}
+		switch {
+		case b.result == PASSED && h.result == FAILED:
+			c.NewFailures = append(c.NewFailures, name)
+		case b.result == FAILED && h.result == PASSED:
+			c.Fixed = append(c.Fixed, name)
+		case b.result != SKIPPED && h.result == SKIPPED:
+			c.NewlySkipped = append(c.NewlySkipped, name)
+		case b.result != UNDETERMINED && h.result == UNDETERMINED:
+			c.NewlyUndetermined = append(c.NewlyUndetermined, name)
+		}
+		if d := h.duration - b.duration; d != 0 {
+			c.TestDurations = append(c.TestDurations, DurationDelta{
+				Name:  name,
+				Base:  b.duration.Seconds(),
+				Head:  h.duration.Seconds(),
+				Delta: d.Seconds(),
+			})
+		}
+	}
+	for name := range baseByName {
+		if _, ok := headByName[name]; !ok {
+			c.Removed = append(c.Removed, name)
+		}
+	}
+
+	basePkgByName := make(map[string]*PackageResult)
+	for _, p := range basePackages {
+		basePkgByName[p.name] = p
+	}
+	for _, h := range headPackages {
+		b, ok := basePkgByName[h.name]
+		if !ok {
+			continue
+		}
+		if d := h.duration - b.duration; d != 0 {
+			c.PackageDurations = append(c.PackageDurations, DurationDelta{
+				Name:  h.name,
+				Base:  b.duration.Seconds(),
+				Head:  h.duration.Seconds(),
+				Delta: d.Seconds(),
+			})
+		}
+	}
+
+	for _, names := range [][]string{c.NewFailures, c.Fixed, c.Added, c.Removed, c.NewlySkipped, c.NewlyUndetermined} {
+		sort.Strings(names)
+	}
+	sortDeltas(c.TestDurations)
+	sortDeltas(c.PackageDurations)
+	return c
+}
+
+// sortDeltas sorts deltas so that the largest changes come first.
+func sortDeltas(deltas []DurationDelta) {
+	sort.Slice(deltas, func(i, j int) bool {
+		if math.Abs(deltas[i].Delta) != math.Abs(deltas[j].Delta) {
+			return math.Abs(deltas[i].Delta) > math.Abs(deltas[j].Delta)
+		}
+		return deltas[i].Name < deltas[j].Name
+	})
+}
+
+// testSection is a titled list of test names.
+type testSection struct {
+	title string
+	names []string
+}
+
+// comparisonSections returns the titled lists of test names in the order they
+// are written out.
+func (c *Comparison) comparisonSections() []testSection {
+	return []testSection{
+		{"went from passing to failing", c.NewFailures},
+		{"went from failing to passing", c.Fixed},
+		{"were added", c.Added},
+		{"were removed", c.Removed},
+		{"are newly skipped", c.NewlySkipped},
+		{"are newly undetermined", c.NewlyUndetermined},
+	}
+}
+
+// describe returns a one line description of the run.
+func (r RunInfo) describe() string {
+	return "run " + strconv.FormatInt(r.ID, 10) + " (commit " + r.CommitHash + ", " + r.DateTime.Format(referenceTime) + ", " + strconv.Itoa(r.Panics) + " panics)"
+}
+
+// formatSeconds formats a number of seconds, e.g. "2.5s".
+func formatSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', -1, 64) + "s"
+}
+
+// WriteText writes the comparison as plain text.
+func (c *Comparison) WriteText(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("Base: %v\n", c.Base.describe())
+	ew.printf("Head: %v\n", c.Head.describe())
+	for _, s := range c.comparisonSections() {
+		ew.printf("\nFound %d tests that %v.\n", len(s.names), s.title)
+		for _, name := range s.names {
+			ew.printf("\t%v\n", name)
+		}
+	}
+
+	ew.printf("\nFound %d tests whose duration changed.\n", len(c.TestDurations))
+	for _, d := range c.TestDurations {
+		ew.printf("\t%v: %v -> %v (%+gs)\n", d.Name, formatSeconds(d.Base), formatSeconds(d.Head), d.Delta)
+	}
+	ew.printf("\nFound %d packages whose duration changed.\n", len(c.PackageDurations))
+	for _, d := range c.PackageDurations {
+		ew.printf("\t%v: %v -> %v (%+gs)\n", d.Name, formatSeconds(d.Base), formatSeconds(d.Head), d.Delta)
+	}
+	return ew.err
+}
+
+// WriteMarkdown writes the comparison as Markdown, suitable for attaching to a
+// pull request.
+func (c *Comparison) WriteMarkdown(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("## Test comparison\n\n")
+	ew.printf("| | Run | Commit | Date | Panics |\n|---|---|---|---|---|\n")
+	ew.printf("| Base | %d | `%v` | %v | %d |\n", c.Base.ID, c.Base.CommitHash, c.Base.DateTime.Format(referenceTime), c.Base.Panics)
+	ew.printf("| Head | %d | `%v` | %v | %d |\n", c.Head.ID, c.Head.CommitHash, c.Head.DateTime.Format(referenceTime), c.Head.Panics)
+	for _, s := range c.comparisonSections() {
+		ew.printf("\n### %d tests %v\n\n", len(s.names), s.title)
+		for _, name := range s.names {
+			ew.printf("- `%v`\n", name)
+		}
+	}
+
+	writeDeltas := func(title string, deltas []DurationDelta) {
+		ew.printf("\n### %d %v whose duration changed\n\n", len(deltas), title)
+		if len(deltas) == 0 {
+			return
+		}
+		ew.printf("| Name | Base | Head | Delta |\n|---|---|---|---|\n")
+		for _, d := range deltas {
+			ew.printf("| `%v` | %v | %v | %+gs |\n", d.Name, formatSeconds(d.Base), formatSeconds(d.Head), d.Delta)
+		}
+	}
+	writeDeltas("tests", c.TestDurations)
+	writeDeltas("packages", c.PackageDurations)
+	return ew.err
+}
+
+// WriteJSON writes the comparison as indented JSON.
+func (c *Comparison) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(c)
+}
+
+// errWriter wraps a writer and remembers the first error, so that long runs of
+// formatted writes only need to be checked once.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+// printf formats and writes to the underlying writer unless an earlier write
+// failed.
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Profile holds the time windows and thresholds used by the analysis queries.
+// A profile lets the same report cover a single day, a weekend, a sprint or
+// the whole life of a release branch.
+type Profile struct {
+	Name string `json:"name"`
+
+	// Project, when set, limits the profile's analyses to the runs of one
+	// project, so that reports on different repositories don't mix.
+	Project string `json:"project,omitempty"`
+
+	// Branch, when set, limits the profile's analyses to the runs of one
+	// branch, such as "master", so that feature branches and pull requests
+	// don't add noise to its health. Without it, the profile covers the runs
+	// of every branch that didn't test a pull request.
+	Branch string `json:"branch,omitempty"`
+
+	// BaselineBranch is the branch whose results performance is compared
+	// against. It defaults to the branch targeted by the latest run, or the
+	// latest run's own branch when it isn't of a pull request.
+	BaselineBranch string `json:"baselineBranch,omitempty"`
+
+	// Repo is a git checkout used to link newly failing tests to the changes
+	// that could have broken them. It defaults to the repo of the profile's
+	// project.
+	Repo string `json:"repo,omitempty"`
+
+	// Window is how far back failures and panics are reported from.
+	Window Window `json:"window"`
+
+	// Baseline is how far back passing results are averaged when looking for
+	// performance changes, and how far back the set of tests run is compared
+	// against when looking for tests that stopped running.
+	Baseline Window `json:"baseline"`
+
+	// PerfChangeRatio is the fraction by which a test's duration must change
+	// from the baseline to be reported, e.g. 0.2 for 20%.
+	PerfChangeRatio float64 `json:"perfChangeRatio"`
+
+	// PerfMinDelta is the minimum change in seconds for a performance change
+	// to be reported.
+	PerfMinDelta float64 `json:"perfMinDelta"`
+
+	// PerfMinDuration is the duration in seconds under which tests are
+	// considered too short to report performance changes for.
+	PerfMinDuration float64 `json:"perfMinDuration"`
+
+	// SkipRateJump is how much the fraction of runs in which a test was
+	// skipped must grow from the baseline to the window to be reported, e.g.
+	// 0.5 for a test skipped in half of its runs more than before.
+	SkipRateJump float64 `json:"skipRateJump"`
+
+	// TextTemplate and HTMLTemplate are paths to templates used to render
+	// the update instead of the default layout.
+	TextTemplate string `json:"textTemplate,omitempty"`
+	HTMLTemplate string `json:"htmlTemplate,omitempty"`
+
+	// Notifiers are where the update is sent when -getUpdate is given no
+	// file, format or recipient.
+	Notifiers []*NotifierConfig `json:"notifiers,omitempty"`
+
+	// Subscriptions are sent digests of the update alongside Notifiers.
+	Subscriptions []*Subscription `json:"subscriptions,omitempty"`
+
+	// Schedule is a cron expression, such as "0 6 * * *", giving when the
+	// daemon sends the update.
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// Config is the layout of the file given with the -config flag.
+type Config struct {
+	Profiles map[string]*Profile `json:"profiles"`
+
+	// Projects holds the parser settings of each project, by name.
+	Projects map[string]*ProjectConfig `json:"projects,omitempty"`
+}
+
+// ProjectConfig holds how the logs of a project are parsed.
+type ProjectConfig struct {
+	// PackagePrefix is the import path prefix, such as
+	// "github.com/NebulousLabs/Sia/", trimmed from the project's package
+	// names.
+	PackagePrefix string `json:"packagePrefix,omitempty"`
+
+	// Input is the format of the project's logs when none is given: text,
+	// test2json or junit.
+	Input string `json:"input,omitempty"`
+
+	// Repo is a git checkout of the project that the commits of its runs
+	// are read from.
+	Repo string `json:"repo,omitempty"`
+}
+
+// projectFilter and branchFilter are the SQL conditions limiting a query on
+// tests or packages to a project or branch, each taking its value twice. An
+// empty project matches every run, and an empty branch every run that isn't
+// of a pull request, so that pull requests don't become part of a report
+// that doesn't ask for them.
+const (
+	projectFilter string = "(? = '' or project = ?)"
+	branchFilter  string = "runID in (select id from runs where (? = '' and pullRequest is null) or branch = ?)"
+)
+
+// scopeFilter limits a query on tests or packages to the project and branch
+// of the profile, taking the arguments returned by scopeArgs. runScopeFilter
+// does the same for a query on runs with the alias r.
+const (
+	scopeFilter    string = projectFilter + " and " + branchFilter
+	runScopeFilter string = "(? = '' or r.project = ?) and ((? = '' and r.pullRequest is null) or r.branch = ?)"
+)
+
+// scopeArgs returns the arguments of scopeFilter and runScopeFilter for the
+// environment's profile.
+func (env *Environment) scopeArgs() []interface{} {
+	var project, branch string
+	if env.profile != nil {
+		project, branch = env.profile.Project, env.profile.Branch
+	}
+	return []interface{}{project, project, branch, branch}
+}
+
+// Window is a time.Duration that can be written as "36h", "3d" or "2w" in
+// config files and flags.
+type Window time.Duration
+
+// builtinProfiles are the profiles available without a config file.
+var builtinProfiles = map[string]*Profile{
+	"daily": {
+		Name:            "daily",
+		Window:          Window(24 * time.Hour),
+		Baseline:        Window(7 * 24 * time.Hour),
+		PerfChangeRatio: 0.2,
+		PerfMinDelta:    2.5,
+		PerfMinDuration: 5.0,
+		SkipRateJump:    0.5,
+	},
+	"weekly": {
+		Name:            "weekly",
+		Window:          Window(7 * 24 * time.Hour),
+		Baseline:        Window(28 * 24 * time.Hour),
+		PerfChangeRatio: 0.2,
+		PerfMinDelta:    2.5,
+		PerfMinDuration: 5.0,
+		SkipRateJump:    0.5,
+	},
+	"release": {
+		Name:            "release",
+		Window:          Window(90 * 24 * time.Hour),
+		Baseline:        Window(180 * 24 * time.Hour),
+		PerfChangeRatio: 0.1,
+		PerfMinDelta:    1.0,
+		PerfMinDuration: 2.0,
+		SkipRateJump:    0.25,
+	},
+}
+
+// defaultProfile is the profile used when none is given.
+const defaultProfile string = "daily"
+
+// ParseWindow parses a window such as "24h", "3d" or "2w". Anything accepted
+// by time.ParseDuration is also accepted.
+func ParseWindow(s string) (Window, error) {
+	s = strings.TrimSpace(s)
+	var unit time.Duration
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+		return Window(d), nil
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSuffix(s, "d"), "w"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid window %q", s)
+	}
+	return Window(time.Duration(n * float64(unit))), nil
+}
+
+// Seconds returns the window length in whole seconds, which is what the SQL
+// queries expect for their INTERVAL arguments.
+func (w Window) Seconds() int64 {
+	return int64(time.Duration(w) / time.Second)
+}
+
+// String formats the window in days when it is a whole number of days.
+func (w Window) String() string {
+	d := time.Duration(w)
+	if d != 0 && d%(24*time.Hour) == 0 {
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	}
+	return d.String()
+}
+
+// MarshalJSON writes the window as a string such as "7d".
+func (w Window) MarshalJSON() ([]byte, error) {
+	return json.Marshal(w.String())
+}
+
+// UnmarshalJSON reads the window from a string such as "7d".
+func (w *Window) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseWindow(s)
+	if err != nil {
+		return err
+	}
+	*w = parsed
+	return nil
+}
+
+// LoadConfig reads a JSON config file from the given path. Profiles in the
+// file are merged on top of the built-in profiles, so a file only needs to
+// list the fields it changes.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{Profiles: make(map[string]*Profile)}
+	for name, p := range builtinProfiles {
+		copied := *p
+		cfg.Profiles[name] = &copied
+	}
+	if path == "" {
+		return cfg, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var fromFile struct {
+		Profiles map[string]json.RawMessage `json:"profiles"`
+		Projects map[string]*ProjectConfig  `json:"projects"`
+	}
+	if err := json.NewDecoder(f).Decode(&fromFile); err != nil {
+		return nil, fmt.Errorf("parsing config %v: %v", path, err)
+	}
+	for name, raw := range fromFile.Profiles {
+		// Start new profiles from the default profile so that omitted fields
+		// are still sensible.
+		base, ok := cfg.Profiles[name]
+		if !ok {
+			copied := *builtinProfiles[defaultProfile]
+			base = &copied
+		}
+		if err := json.Unmarshal(raw, base); err != nil {
+			return nil, fmt.Errorf("parsing profile %v: %v", name, err)
+		}
+		base.Name = name
+		cfg.Profiles[name] = base
+	}
+	cfg.Projects = fromFile.Projects
+	for name, p := range cfg.Projects {
+		if p == nil {
+			return nil, fmt.Errorf("project %v has no settings", name)
+		}
+		if p.Input != "" && !containsString(logFormats, p.Input) {
+			return nil, fmt.Errorf("project %v: unknown input %q, expected one of %v", name, p.Input, strings.Join(logFormats, ", "))
+		}
+	}
+	for _, p := range cfg.Profiles {
+		if project, ok := cfg.Projects[p.Project]; ok && p.Repo == "" {
+			p.Repo = project.Repo
+		}
+	}
+	return cfg, nil
+}
+
+// defaultPackagePrefix is trimmed from the package names of runs without a
+// project, so that they are stored as they were before projects had prefixes
+// of their own.
+const defaultPackagePrefix = "github.com/NebulousLabs/Sia/"
+
+// applyProject fills in the parser settings of the run's project that meta
+// doesn't already give. Runs without a project get defaultPackagePrefix.
+func (c *Config) applyProject(meta *runMetadata) {
+	if meta.project == "" {
+		if meta.packagePrefix == "" {
+			meta.packagePrefix = defaultPackagePrefix
+		}
+		return
+	}
+	p, ok := c.Projects[meta.project]
+	if !ok {
+		return
+	}
+	if meta.packagePrefix == "" {
+		meta.packagePrefix = p.PackagePrefix
+	}
+	if meta.format == "" {
+		meta.format = p.Input
+	}
+	if meta.repo == "" {
+		meta.repo = p.Repo
+	}
+}
+
+// setProject switches the profile to the given project, taking the project's
+// repo in place of the one the profile only had from its previous project.
+func (c *Config) setProject(p *Profile, project string) {
+	if old, ok := c.Projects[p.Project]; ok && p.Repo == old.Repo {
+		p.Repo = ""
+	}
+	p.Project = project
+	if proj, ok := c.Projects[project]; ok && p.Repo == "" {
+		p.Repo = proj.Repo
+	}
+}
+
+// Profile returns the profile with the given name.
+func (c *Config) Profile(name string) (*Profile, error) {
+	p, ok := c.Profiles[name]
+	if !ok {
+		var names []string
+		for n := range c.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %q, expected one of %v", name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
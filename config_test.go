@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestApplyProject(t *testing.T) {
+	cfg := &Config{Projects: map[string]*ProjectConfig{
+		"hostdb": {PackagePrefix: "gitlab.com/acme/hostdb/", Input: "test2json", Repo: "/srv/hostdb"},
+	}}
+	for _, c := range []struct {
+		meta                 runMetadata
+		prefix, format, repo string
+	}{
+		{runMetadata{}, defaultPackagePrefix, "", ""},
+		{runMetadata{packagePrefix: "example.com/"}, "example.com/", "", ""},
+		{runMetadata{project: "hostdb"}, "gitlab.com/acme/hostdb/", "test2json", "/srv/hostdb"},
+		{runMetadata{project: "hostdb", format: "junit", repo: "/tmp/hostdb"}, "gitlab.com/acme/hostdb/", "junit", "/tmp/hostdb"},
+		{runMetadata{project: "unknown"}, "", "", ""},
+	} {
+		meta := c.meta
+		cfg.applyProject(&meta)
+		if meta.packagePrefix != c.prefix || meta.format != c.format || meta.repo != c.repo {
+			t.Errorf("project %q: got prefix %q, format %q and repo %q, want %q, %q and %q", c.meta.project, meta.packagePrefix, meta.format, meta.repo, c.prefix, c.format, c.repo)
+		}
+	}
+}
+
+func TestSetProject(t *testing.T) {
+	cfg := &Config{Projects: map[string]*ProjectConfig{
+		"sia":    {Repo: "/srv/sia"},
+		"hostdb": {Repo: "/srv/hostdb"},
+	}}
+	for _, c := range []struct {
+		profile Profile
+		project string
+		repo    string
+	}{
+		{Profile{}, "hostdb", "/srv/hostdb"},
+		{Profile{Project: "sia", Repo: "/srv/sia"}, "hostdb", "/srv/hostdb"},
+		{Profile{Project: "sia", Repo: "/home/me/sia"}, "hostdb", "/home/me/sia"},
+		{Profile{Project: "sia", Repo: "/srv/sia"}, "unknown", ""},
+	} {
+		p := c.profile
+		cfg.setProject(&p, c.project)
+		if p.Project != c.project || p.Repo != c.repo {
+			t.Errorf("switching %+v to %q gave project %q and repo %q, want repo %q", c.profile, c.project, p.Project, p.Repo, c.repo)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"* * * * *", "0 6 * * 1-5", "*/15 0-23/2 1,15 * 7", "@daily", " @hourly ", "59 23 31 12 0"} {
+		if _, err := parseCron(expr); err != nil {
+			t.Errorf("parseCron(%q) = %v, want nil", expr, err)
+		}
+	}
+	for _, expr := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *", "1-x * * * *", "@fortnightly"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2024-01-01 was a Monday.
+	date := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2024, month, day, hour, min, 0, 0, time.UTC)
+	}
+	for _, c := range []struct {
+		expr       string
+		from, want time.Time
+	}{
+		{"* * * * *", date(1, 1, 10, 0), date(1, 1, 10, 1)},
+		{"* * * * *", date(1, 1, 10, 0).Add(30 * time.Second), date(1, 1, 10, 1)},
+		{"@hourly", date(1, 1, 10, 0), date(1, 1, 11, 0)},
+		{"@daily", date(1, 1, 10, 0), date(1, 2, 0, 0)},
+		{"@monthly", date(1, 31, 10, 0), date(2, 1, 0, 0)},
+		{"@yearly", date(1, 1, 0, 0), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", date(1, 1, 10, 20), date(1, 1, 10, 30)},
+		{"30 6 * * *", date(1, 1, 6, 30), date(1, 2, 6, 30)},
+		{"0 0-23/6 * * *", date(1, 1, 7, 0), date(1, 1, 12, 0)},
+
+		// Weekdays only, from a Friday evening.
+		{"0 6 * * 1-5", date(1, 5, 18, 0), date(1, 8, 6, 0)},
+
+		// Sunday is 0 or 7.
+		{"0 0 * * 0", date(1, 1, 0, 0), date(1, 7, 0, 0)},
+		{"0 0 * * 7", date(1, 1, 0, 0), date(1, 7, 0, 0)},
+		{"@weekly", date(1, 1, 0, 0), date(1, 7, 0, 0)},
+
+		// When both the day of month and the day of week are restricted, a
+		// day matching either is allowed: the 15th or any Friday.
+		{"0 0 15 * 5", date(1, 1, 0, 0), date(1, 5, 0, 0)},
+		{"0 0 15 * 5", date(1, 13, 0, 0), date(1, 15, 0, 0)},
+		// With only one restricted, both must match.
+		{"0 0 13 * *", date(1, 1, 0, 0), date(1, 13, 0, 0)},
+		{"0 0 * * 5", date(1, 6, 0, 0), date(1, 12, 0, 0)},
+
+		// Months without the day are skipped, and a leap day is found.
+		{"0 0 31 * *", date(1, 31, 0, 0), date(3, 31, 0, 0)},
+		{"0 0 29 2 *", date(3, 1, 0, 0), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+
+		// A day that never comes gives the zero time.
+		{"0 0 30 2 *", date(1, 1, 0, 0), time.Time{}},
+	} {
+		s, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", c.expr, err)
+		}
+		if got := s.next(c.from); !got.Equal(c.want) {
+			t.Errorf("%q: next(%v) = %v, want %v", c.expr, c.from, got, c.want)
+		}
+	}
+}
+
+func TestScheduledReportDue(t *testing.T) {
+	s, err := parseCron("@hourly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	sr := &scheduledReport{schedule: s, last: last}
+	if got, want := sr.due(), last.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("due() = %v, want %v", got, want)
+	}
+
+	// A failed update is due again when it is retried, not straight away.
+	sr.retry = last.Add(time.Hour + scheduleRetryInterval)
+	if got := sr.due(); !got.Equal(sr.retry) {
+		t.Errorf("due() after a failure = %v, want %v", got, sr.retry)
+	}
+	// A retry doesn't hold back later scheduled times.
+	sr.retry = last.Add(-scheduleRetryInterval)
+	if got, want := sr.due(), last.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("due() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// scheduledReport is a profile whose update is sent on a schedule.
+type scheduledReport struct {
+	env      *Environment
+	schedule *cronSchedule
+
+	// last is the scheduled time most recently handled, and lastRunID the
+	// newest run when an update was last sent.
+	last      time.Time
+	lastRunID int64
+
+	// retry is when an update that failed is tried again.
+	retry time.Time
+}
+
+// scheduleRetryInterval is how long the daemon waits before trying a failed
+// update again.
+const scheduleRetryInterval = 10 * time.Minute
+
+// loadScheduleState reads when the profile's update was last handled. A
+// profile that was never handled starts from now, so that starting the daemon
+// doesn't send an update straight away.
+func (env *Environment) loadScheduleState(profile string) (last time.Time, lastRunID int64, err error) {
+	err = env.db.QueryRow("select lastReport, lastRunID from reportSchedule where profile = ?;", profile).Scan(&last, &lastRunID)
+	if err == sql.ErrNoRows {
+		return time.Now(), 0, nil
+	}
+	// Schedules are in local time.
+	return last.Local(), lastRunID, err
+}
+
+// saveScheduleState records when the profile's update was last handled.
+func (env *Environment) saveScheduleState(profile string, last time.Time, lastRunID int64) error {
+	_, err := env.db.Exec("INSERT INTO reportSchedule (profile, lastReport, lastRunID) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE lastReport = VALUES(lastReport), lastRunID = VALUES(lastRunID);", profile, last, lastRunID)
+	return err
+}
+
+// latestRunID returns the ID of the most recently inserted run of the
+// profile's project, or 0 if there are none.
+func (env *Environment) latestRunID() (int64, error) {
+	var id sql.NullInt64
+	err := env.db.QueryRow("select max(r.id) from runs r where "+runScopeFilter+";", env.scopeArgs()...).Scan(&id)
+	return id.Int64, err
+}
+
+// send sends the scheduled update unless no runs were inserted since the last
+// one, and records that the schedule was handled at now. An update that can't
+// be gathered or sent is logged and left unhandled, to be tried again after
+// scheduleRetryInterval.
+func (sr *scheduledReport) send(now time.Time) {
+	name := sr.env.profile.Name
+	newest, err := sr.env.latestRunID()
+	if err != nil {
+		log.Printf("%s: error selecting latest run: %v", name, err)
+		sr.retry = now.Add(scheduleRetryInterval)
+		return
+	}
+
+	if newest == sr.lastRunID {
+		log.Printf("%s: no new runs since the last update, skipping", name)
+	} else if err := sr.env.notifyUpdate(); err != nil {
+		log.Printf("%s: error sending update, retrying at %v: %v", name, now.Add(scheduleRetryInterval).Format(time.RFC3339), err)
+		sr.retry = now.Add(scheduleRetryInterval)
+		return
+	} else {
+		log.Printf("%s: sent update", name)
+		sr.lastRunID = newest
+	}
+
+	sr.last = now
+	sr.retry = time.Time{}
+	if err := sr.env.saveScheduleState(name, sr.last, sr.lastRunID); err != nil {
+		log.Printf("%s: error saving schedule state: %v", name, err)
+	}
+}
+
+// due returns when the update is next to be sent: its next scheduled time,
+// or the time it is retried if that is later. It is zero if the schedule has
+// no more times.
+func (sr *scheduledReport) due() time.Time {
+	next := sr.schedule.next(sr.last)
+	if !next.IsZero() && next.Before(sr.retry) {
+		return sr.retry
+	}
+	return next
+}
+
+// scheduledReports returns a scheduledReport for every profile in the config
+// that has a schedule.
+func scheduledReports(db *sql.DB, cfg *Config) ([]*scheduledReport, error) {
+	var names []string
+	for name, p := range cfg.Profiles {
+		if p.Schedule != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var reports []*scheduledReport
+	for _, name := range names {
+		p := cfg.Profiles[name]
+		schedule, err := parseCron(p.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("profile %v: %v", name, err)
+		}
+		if len(p.Notifiers) == 0 && len(p.Subscriptions) == 0 {
+			return nil, fmt.Errorf("profile %v has a schedule but no notifiers or subscriptions", name)
+		}
+		env := &Environment{db: db, profile: p}
+		last, lastRunID, err := env.loadScheduleState(name)
+		if err != nil {
+			return nil, fmt.Errorf("loading schedule state of %v: %v", name, err)
+		}
+		reports = append(reports, &scheduledReport{
+			env:       env,
+			schedule:  schedule,
+			last:      last,
+			lastRunID: lastRunID,
+		})
+	}
+	return reports, nil
+}
+
+// runSchedules sends each scheduled update when it is due until a signal
+// arrives on stop. An update whose scheduled time passed while the daemon wasn't
+// running is sent once, straight away.
+func runSchedules(reports []*scheduledReport, stop <-chan os.Signal) {
+	for {
+		var wake time.Time
+		for _, sr := range reports {
+			next := sr.due()
+			if !next.IsZero() && (wake.IsZero() || next.Before(wake)) {
+				wake = next
+			}
+		}
+		if wake.IsZero() {
+			log.Print("No scheduled updates left to send")
+			return
+		}
+
+		if d := time.Until(wake); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case sig := <-stop:
+				timer.Stop()
+				log.Printf("Received %v, stopping", sig)
+				return
+			}
+		}
+
+		now := time.Now()
+		for _, sr := range reports {
+			if next := sr.due(); !next.IsZero() && !next.After(now) {
+				sr.send(now)
+			}
+		}
+	}
+}
+
+func init() {
+	commands["daemon"] = daemonCommand
+}
+
+// daemonCommand runs the "daemon" subcommand, which keeps running and sends
+// the update of every profile with a schedule.
+func daemonCommand(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	dbInfoPtr := fs.String("dbinfo", "db-info.txt", "file in which db information is contained")
+	configPtr := fs.String("config", "", "JSON file containing report profiles with schedules")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s daemon -config FILE [flags]\n\nSends the update of every profile that has a schedule, when it is due.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(*configPtr)
+	if err != nil {
+		log.Fatal("Error loading config: ", err)
+	}
+	env := openEnvironment(*dbInfoPtr, nil)
+	defer env.db.Close()
+
+	reports, err := scheduledReports(env.db, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(reports) == 0 {
+		log.Fatal("No profiles have a schedule")
+	}
+	for _, sr := range reports {
+		log.Printf("%s: scheduled %q, next update at %v", sr.env.profile.Name, sr.env.profile.Schedule, sr.due().Format(time.RFC3339))
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	runSchedules(reports, stop)
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcinja/go-testdb/report"
+)
+
+// Sizes, in pixels, of the charts on the dashboard.
+const (
+	durationChartWidth  = 720
+	durationChartHeight = 160
+	resultStripCell     = 10
+	resultStripHeight   = 20
+)
+
+// resultColors are the colors results are drawn in, matching the update's
+// outcome chart.
+var resultColors = map[string]string{
+	StatusStrings[PASSED]:       "#2e8b57",
+	StatusStrings[FAILED]:       "#c0392b",
+	StatusStrings[SKIPPED]:      "#c8a951",
+	StatusStrings[UNDETERMINED]: "#8e7cc3",
+}
+
+// The dashboard's pages are each rendered by the template of the same name
+// inside layout.html.tmpl. They must stay self-contained, like the HTML
+// update, so that the dashboard works offline.
+//
+//go:embed templates/dashboard
+var dashboardFS embed.FS
+
+// dashboardPages maps page names to their parsed templates.
+var dashboardPages = parseDashboardPages("runs", "run", "test", "flaky", "panics", "error")
+
+// parseDashboardPages parses the embedded templates of the named pages.
+func parseDashboardPages(names ...string) map[string]*htmltemplate.Template {
+	funcs := htmltemplate.FuncMap{
+		"testURL":       testURL,
+		"runURL":        runURL,
+		"durationChart": durationChart,
+		"resultStrip":   resultStrip,
+	}
+	pages := make(map[string]*htmltemplate.Template)
+	for _, name := range names {
+		pages[name] = htmltemplate.Must(htmltemplate.New("layout.html.tmpl").
+			Funcs(reportFuncs).Funcs(htmlReportFuncs).Funcs(funcs).
+			ParseFS(dashboardFS, "templates/dashboard/layout.html.tmpl", "templates/dashboard/"+name+".html.tmpl"))
+	}
+	return pages
+}
+
+// testURL returns the path of a test's page. Each part of a subtest's name
+// is escaped, since they may hold characters such as '#'.
+func testURL(name string) string {
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return "/tests/" + strings.Join(parts, "/")
+}
+
+// runURL returns the path of a run's page.
+func runURL(id int64) string {
+	return "/runs/" + strconv.FormatInt(id, 10)
+}
+
+// dashboardRun is a row of the runs query.
+type dashboardRun struct {
+	report.Run
+	Branch       string
+	PullRequest  int64
+	TargetBranch string
+	Labels       string
+}
+
+// dashboardRuns converts the rows of the runs query.
+func dashboardRuns(t *table) []*dashboardRun {
+	var runs []*dashboardRun
+	for _, row := range t.rows {
+		runs = append(runs, &dashboardRun{
+			Run: report.Run{
+				ID:           row[0].(int64),
+				CommitHash:   row[1].(string),
+				DateTime:     row[5].(time.Time),
+				Passed:       int(row[7].(int64)),
+				Failed:       int(row[8].(int64)),
+				Skipped:      int(row[9].(int64)),
+				Undetermined: int(row[10].(int64)),
+				Panics:       int(row[11].(int64)),
+			},
+			Branch:       row[2].(string),
+			PullRequest:  row[3].(int64),
+			TargetBranch: row[4].(string),
+			Labels:       row[6].(string),
+		})
+	}
+	return runs
+}
+
+// historyPoint is a row of a test's history.
+type historyPoint struct {
+	RunID      int64
+	CommitHash string
+	DateTime   time.Time
+	Package    string
+	Result     string
+	Duration   float64
+	Output     string
+}
+
+// historyPoints converts the rows of a test's history.
+func historyPoints(t *table) []*historyPoint {
+	var points []*historyPoint
+	for _, row := range t.rows {
+		points = append(points, &historyPoint{
+			RunID:      row[0].(int64),
+			CommitHash: row[1].(string),
+			DateTime:   row[2].(time.Time),
+			Package:    row[3].(string),
+			Result:     row[4].(string),
+			Duration:   row[5].(float64),
+			Output:     row[6].(string),
+		})
+	}
+	return points
+}
+
+// durationChart draws the duration of each result of a test as a point
+// colored by its result, with passing results joined by a line. Each point
+// links to its run.
+func durationChart(points []*historyPoint) htmltemplate.HTML {
+	if len(points) == 0 {
+		return ""
+	}
+	var max float64
+	for _, p := range points {
+		if p.Duration > max {
+			max = p.Duration
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+
+	const pad = 6
+	x := func(i int) float64 {
+		if len(points) == 1 {
+			return durationChartWidth / 2
+		}
+		return pad + float64(i)*float64(durationChartWidth-2*pad)/float64(len(points)-1)
+	}
+	y := func(d float64) float64 {
+		return pad + (1-d/max)*float64(durationChartHeight-2*pad)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="chart" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="durations up to %.2fs">`, durationChartWidth, durationChartHeight, durationChartWidth, durationChartHeight, max)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" class="axis">%.2fs</text>`, pad, pad+10, max)
+	var passing []string
+	for i, p := range points {
+		if p.Result == StatusStrings[PASSED] {
+			passing = append(passing, fmt.Sprintf("%.1f,%.1f", x(i), y(p.Duration)))
+		}
+	}
+	fmt.Fprintf(&b, `<polyline fill="none" stroke="#3b6ea5" stroke-width="1" points="%s"/>`, strings.Join(passing, " "))
+	for i, p := range points {
+		fmt.Fprintf(&b, `<a href="%s"><title>run %d, %s: %s in %.2fs</title><circle cx="%.1f" cy="%.1f" r="3" fill="%s"/></a>`,
+			runURL(p.RunID), p.RunID, p.DateTime.Format(referenceTime), p.Result, p.Duration, x(i), y(p.Duration), resultColors[p.Result])
+	}
+	b.WriteString(`</svg>`)
+	return htmltemplate.HTML(b.String())
+}
+
+// resultStrip draws a cell for each result of a test, colored by its result
+// and linking to its run, oldest first.
+func resultStrip(points []*historyPoint) htmltemplate.HTML {
+	if len(points) == 0 {
+		return ""
+	}
+	width := len(points) * (resultStripCell + 1)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="strip" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="results, oldest first">`, width, resultStripHeight, width, resultStripHeight)
+	for i, p := range points {
+		fmt.Fprintf(&b, `<a href="%s"><title>run %d, %s: %s</title><rect x="%d" y="0" width="%d" height="%d" fill="%s"/></a>`,
+			runURL(p.RunID), p.RunID, p.DateTime.Format(referenceTime), p.Result, i*(resultStripCell+1), resultStripCell, resultStripHeight, resultColors[p.Result])
+	}
+	b.WriteString(`</svg>`)
+	return htmltemplate.HTML(b.String())
+}
+
+// renderPage writes the named dashboard page.
+func renderPage(w http.ResponseWriter, status int, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := dashboardPages[name].Execute(&buf, data); err != nil {
+		log.Printf("Error rendering %v page: %v", name, err)
+		http.Error(w, "error rendering page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Print("Error writing response: ", err)
+	}
+}
+
+// renderErrorPage writes a dashboard page describing an error.
+func renderErrorPage(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	renderPage(w, status, "error", struct {
+		Title   string
+		Message string
+	}{http.StatusText(status), fmt.Sprintf(format, args...)})
+}
+
+// dashboardFilter holds the filter parameters of a page, to fill in its form
+// again.
+type dashboardFilter struct {
+	Window, Package, Status, Label, Branch, Project string
+}
+
+// handleDashboard serves the runs timeline at /, and an error page for any
+// other path not served by something else.
+func (s *server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		renderErrorPage(w, http.StatusNotFound, "Nothing is served at %v.", r.URL.Path)
+		return
+	}
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	q := r.URL.Query()
+	f, err := s.queryFilterFromRequest(r)
+	if err != nil {
+		renderErrorPage(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	p, err := pageFromRequest(q)
+	if err != nil {
+		renderErrorPage(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	f.limit, f.offset = p.Limit, p.Offset
+	t, err := s.env.Runs(f)
+	if err != nil {
+		renderErrorPage(w, http.StatusInternalServerError, "Error selecting runs: %v", err)
+		return
+	}
+	if p.Total, err = s.env.RunCount(f); err != nil {
+		renderErrorPage(w, http.StatusInternalServerError, "Error counting runs: %v", err)
+		return
+	}
+	runs := dashboardRuns(t)
+	start := p.Offset
+	if start > p.Total {
+		start = p.Total
+	}
+	end := start + len(runs)
+
+	// Runs are listed newest first, but charted oldest first.
+	charted := make([]*report.Run, len(runs))
+	for i, run := range runs {
+		charted[len(runs)-1-i] = &run.Run
+	}
+
+	pageURL := func(offset int) string {
+		pq := url.Values{}
+		for k, v := range q {
+			pq[k] = v
+		}
+		pq.Set("offset", strconv.Itoa(offset))
+		return "/?" + pq.Encode()
+	}
+	var newer, older string
+	if start > 0 {
+		prev := start - p.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		newer = pageURL(prev)
+	}
+	if end < p.Total {
+		older = pageURL(end)
+	}
+
+	renderPage(w, http.StatusOK, "runs", struct {
+		Title        string
+		Filter       dashboardFilter
+		Runs         []*dashboardRun
+		Chart        htmltemplate.HTML
+		Total        int
+		First, Last  int
+		Newer, Older string
+	}{
+		Title:  "Runs",
+		Filter: dashboardFilter{q.Get("window"), q.Get("package"), q.Get("status"), q.Get("label"), q.Get("branch"), q.Get("project")},
+		Runs:   runs,
+		Chart:  linkedOutcomeChart(charted, runURL),
+		Total:  p.Total,
+		First:  start + 1,
+		Last:   end,
+		Newer:  newer,
+		Older:  older,
+	})
+}
+
+// dashboardCommit is the commit metadata shown on a run's page.
+type dashboardCommit struct {
+	Author    string
+	Committed time.Time
+	Subject   string
+	Parents   []string
+	Files     []string
+}
+
+// dashboardTest is a test result shown on a run's page.
+type dashboardTest struct {
+	Name     string
+	Package  string
+	Result   string
+	Duration float64
+	Output   string
+	Race     bool
+}
+
+// handleDashboardRun serves /runs/{ref}: a run's packages, and its tests with
+// the output of those that didn't pass.
+func (s *server) handleDashboardRun(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	run, err := s.refEnvironment(r).resolveRun(strings.TrimPrefix(r.URL.Path, "/runs/"))
+	if err == nil && !requestMayRead(r, run) {
+		err = fmt.Errorf("%w with ID %v", errNoRun, run.id)
+	}
+	if errors.Is(err, errNoRun) {
+		renderErrorPage(w, http.StatusNotFound, "%v", err)
+		return
+	}
+	if err != nil {
+		renderErrorPage(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	t, err := s.env.Runs(&queryFilter{run: run})
+	if err != nil {
+		renderErrorPage(w, http.StatusInternalServerError, "Error selecting run: %v", err)
+		return
+	}
+	runs := dashboardRuns(t)
+	if len(runs) == 0 {
+		renderErrorPage(w, http.StatusNotFound, "No run with ID %v.", run.id)
+		return
+	}
+	packages, err := s.env.runPackageResults(run.id)
+	if err != nil {
+		renderErrorPage(w, http.StatusInternalServerError, "Error selecting packages: %v", err)
+		return
+	}
+	tests, err := s.env.runTestResults(run.id)
+	if err != nil {
+		renderErrorPage(w, http.StatusInternalServerError, "Error selecting tests: %v", err)
+		return
+	}
+	c, err := s.env.storedCommit(run.commitHash)
+	if err != nil {
+		renderErrorPage(w, http.StatusInternalServerError, "Error selecting commit: %v", err)
+		return
+	}
+	var commit *dashboardCommit
+	if c != nil {
+		commit = &dashboardCommit{Author: c.author, Committed: c.committed, Subject: c.subject, Parents: c.parents, Files: c.files}
+	}
+
+	sort.Slice(packages, func(i, j int) bool { return packages[i].name < packages[j].name })
+	sort.Slice(tests, func(i, j int) bool {
+		if tests[i].pkg != tests[j].pkg {
+			return tests[i].pkg < tests[j].pkg
+		}
+		return tests[i].name < tests[j].name
+	})
+	var pkgs []*dashboardTest
+	for _, p := range packages {
+		pkgs = append(pkgs, &dashboardTest{Name: p.name, Result: p.result.String(), Duration: p.duration.Seconds()})
+	}
+	var problems, others []*dashboardTest
+	for _, t := range tests {
+		dt := &dashboardTest{
+			Name:     t.name,
+			Package:  t.pkg,
+			Result:   t.result.String(),
+			Duration: t.duration.Seconds(),
+			Output:   t.output,
+			Race:     strings.Contains(t.output, raceMarker),
+		}
+		if t.result == FAILED || t.result == UNDETERMINED || dt.Race {
+			problems = append(problems, dt)
+		} else {
+			others = append(others, dt)
+		}
+	}
+
+	renderPage(w, http.StatusOK, "run", struct {
+		Title    string
+		Run      *dashboardRun
+		Commit   *dashboardCommit
+		Packages []*dashboardTest
+		Problems []*dashboardTest
+		Others   []*dashboardTest
+	}{
+		Title:    fmt.Sprintf("Run %d", run.id),
+		Run:      runs[0],
+		Commit:   commit,
+		Packages: pkgs,
+		Problems: problems,
+		Others:   others,
+	})
+}
+
+// handleDashboardTest serves /tests/{name}: a test's durations and results
+// over time.
+func (s *server) handleDashboardTest(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/tests/")
+	q := r.URL.Query()
+	f, err := s.queryFilterFromRequest(r)
+	if err != nil {
+		renderErrorPage(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	t, err := s.env.TestHistory(name, f)
+	if err != nil {
+		renderErrorPage(w, http.StatusInternalServerError, "Error selecting history: %v", err)
+		return
+	}
+	points := historyPoints(t)
+
+	var passed int
+	newestFirst := make([]*historyPoint, len(points))
+	for i, p := range points {
+		if p.Result == StatusStrings[PASSED] {
+			passed++
+		}
+		newestFirst[len(points)-1-i] = p
+	}
+	var passRate float64
+	if len(points) > 0 {
+		passRate = float64(passed) / float64(len(points))
+	}
+
+	renderPage(w, http.StatusOK, "test", struct {
+		Title    string
+		Name     string
+		Filter   dashboardFilter
+		Points   []*historyPoint
+		History  []*historyPoint
+		PassRate float64
+	}{
+		Title:    name,
+		Name:     name,
+		Filter:   dashboardFilter{q.Get("window"), q.Get("package"), q.Get("status"), q.Get("label"), q.Get("branch"), q.Get("project")},
+		Points:   points,
+		History:  newestFirst,
+		PassRate: passRate,
+	})
+}
+
+// handleDashboardFlaky serves /flaky: the flaky tests within the window of
+// the profile given by the profile parameter.
+func (s *server) handleDashboardFlaky(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	q := r.URL.Query()
+	env, err := s.profileEnvironment(r)
+	if err != nil {
+		renderErrorPage(w, profileErrorStatus(err), "%v", err)
+		return
+	}
+	flaky, err := env.flakyTestsBetween(env.profile.Window, 0)
+	if err != nil {
+		renderErrorPage(w, http.StatusInternalServerError, "Error selecting flaky tests: %v", err)
+		return
+	}
+	var matching []*report.FlakyTest
+	for _, f := range flaky {
+		if pkg := q.Get("package"); pkg == "" || matchPackage(pkg, f.Package) {
+			matching = append(matching, f)
+		}
+	}
+
+	renderPage(w, http.StatusOK, "flaky", struct {
+		Title   string
+		Profile string
+		Window  Window
+		Filter  dashboardFilter
+		Flaky   []*report.FlakyTest
+	}{
+		Title:   "Flaky tests",
+		Profile: env.profile.Name,
+		Window:  env.profile.Window,
+		Filter:  dashboardFilter{Window: q.Get("window"), Package: q.Get("package"), Project: env.profile.Project},
+		Flaky:   matching,
+	})
+}
+
+// handleDashboardPanics serves /panics: the panics and data races within the
+// window of the profile given by the profile parameter.
+func (s *server) handleDashboardPanics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	env, err := s.profileEnvironment(r)
+	if err != nil {
+		renderErrorPage(w, profileErrorStatus(err), "%v", err)
+		return
+	}
+	panics, err := env.reportPanics()
+	if err != nil {
+		renderErrorPage(w, http.StatusInternalServerError, "Error selecting panics: %v", err)
+		return
+	}
+	races, err := env.racesFromWindow()
+	if err != nil {
+		renderErrorPage(w, http.StatusInternalServerError, "Error selecting races: %v", err)
+		return
+	}
+	sort.SliceStable(panics, func(i, j int) bool { return panics[i].DateTime.After(panics[j].DateTime) })
+
+	renderPage(w, http.StatusOK, "panics", struct {
+		Title   string
+		Profile string
+		Project string
+		Window  Window
+		Panics  []*report.Panic
+		Races   []*dashboardRace
+	}{
+		Title:   "Panics and races",
+		Profile: env.profile.Name,
+		Project: env.profile.Project,
+		Window:  env.profile.Window,
+		Panics:  panics,
+		Races:   dashboardRaces(races),
+	})
+}
+
+// dashboardRace is a test whose output holds a race report.
+type dashboardRace struct {
+	RunID      int64
+	CommitHash string
+	DateTime   time.Time
+	Name       string
+	Package    string
+	Result     string
+	Output     string
+}
+
+// dashboardRaces converts the results of racesFromWindow.
+func dashboardRaces(results []*failResult) []*dashboardRace {
+	var races []*dashboardRace
+	for _, fr := range results {
+		races = append(races, &dashboardRace{
+			RunID:      fr.runID,
+			CommitHash: fr.commitHash,
+			DateTime:   fr.dateTime,
+			Name:       fr.name,
+			Package:    fr.pkg,
+			Result:     fr.result.String(),
+			Output:     fr.output,
+		})
+	}
+	return races
+}
@@ -1,30 +1,240 @@
 package main
 
 import (
+	"bufio"
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
 // InsertLogToDB records data from a test log at the given file path into the
 // environment's database.
-func (env *Environment) InsertLogToDB(filename string) {
-	results := ParseErrorLog(filename)
+func (env *Environment) InsertLogToDB(filename string, meta *runMetadata) {
+	results, err := parseLogFile(filename, meta)
+	if err != nil {
+		log.Fatal("Error parsing test log: ", err)
+	}
+	if _, err := env.insertResult(results, meta); err != nil {
+		log.Fatal("Error inserting results: ", err)
+	}
+}
 
-	testStmt, err := env.db.Prepare("INSERT tests SET commitHash=?,dateTime=?,name=?,result=?,output=?,duration=?")
+// Formats of test logs that can be inserted.
+const (
+	textLogFormat      = "text"
+	test2jsonLogFormat = "test2json"
+	junitLogFormat     = "junit"
+)
+
+// logFormats are the formats of test logs that can be inserted.
+var logFormats = []string{textLogFormat, test2jsonLogFormat, junitLogFormat}
+
+// logFormatForPath picks the format of a test log from its extension: JUnit
+// XML for .xml files, `go test -json` output for .json files and verbose
+// `go test` output otherwise.
+func logFormatForPath(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".xml":
+		return junitLogFormat
+	case ".json":
+		return test2jsonLogFormat
+	}
+	return textLogFormat
+}
+
+// parseLogFile parses the test log at the given file path in the format given
+// by meta, applying any commit hash and date time it overrides.
+func parseLogFile(filename string, meta *runMetadata) (*Result, error) {
+	if meta == nil {
+		meta = &runMetadata{}
+	}
+	format := meta.format
+	if format == "" {
+		format = logFormatForPath(filename)
+	}
+	if format == textLogFormat {
+		// Text logs take their date time from the file name, unless it is
+		// given.
+		var results *Result
+		var err error
+		if meta.dateTime.IsZero() {
+			results, err = ParseErrorLog(filename)
+		} else {
+			results, err = parseTextLogFile(filename, meta.dateTime)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		applyRunMetadata(results, meta)
+		if results.commitHash != "" {
+			if err := checkCommitHash(results.commitHash); err != nil {
+				return nil, fmt.Errorf("%s: %v", filename, err)
+			}
+		}
+		return results, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	results, err := parseLog(f, format, meta)
 	if err != nil {
-		log.Fatal("Error preparing test insert statement: ", err)
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return results, nil
+}
+
+// parseLog parses a test log in the given format from r, applying any commit
+// hash and date time overridden by meta. Logs without a date time, including
+// text logs read this way since they have no file name to take it from, are
+// given the current time.
+func parseLog(r io.Reader, format string, meta *runMetadata) (*Result, error) {
+	if meta == nil {
+		meta = &runMetadata{}
+	}
+
+	var results *Result
+	var err error
+	switch format {
+	case textLogFormat:
+		var lines []string
+		s := bufio.NewScanner(r)
+		s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for s.Scan() {
+			lines = append(lines, s.Text())
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		results, err = parseLogLines(lines, time.Time{})
+	case test2jsonLogFormat:
+		results, err = ParseTest2JSON(r)
+	case junitLogFormat:
+		results, err = ParseJUnit(r, meta)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected one of %v", format, strings.Join(logFormats, ", "))
 	}
-	packageStmt, err := env.db.Prepare("INSERT packages SET commitHash=?,dateTime=?,name=?,result=?,duration=?")
 	if err != nil {
-		log.Fatal("Error preparing package insert statement: ", err)
+		return nil, err
+	}
+	applyRunMetadata(results, meta)
+	if results.commitHash == "" {
+		return nil, errNoCommitHash
+	}
+	if err := checkCommitHash(results.commitHash); err != nil {
+		return nil, err
 	}
+	if results.dateTime.IsZero() {
+		results.dateTime = time.Now()
+	}
+	return results, nil
+}
+
+// errNoCommitHash is returned for logs that neither contain nor were given a
+// commit hash.
+var errNoCommitHash = errors.New("no commit hash in the log or given for it")
+
+// applyRunMetadata replaces the commit hash and date time of results with
+// those given in meta, and trims its package prefix from package names.
+func applyRunMetadata(results *Result, meta *runMetadata) *Result {
+	if meta.packagePrefix != "" {
+		for _, t := range results.testResults {
+			t.pkg = strings.TrimPrefix(t.pkg, meta.packagePrefix)
+		}
+		for _, p := range results.packageResults {
+			p.name = strings.TrimPrefix(p.name, meta.packagePrefix)
+		}
+	}
+	if meta.commitHash != "" {
+		results.commitHash = meta.commitHash
+	}
+	if !meta.dateTime.IsZero() {
+		results.dateTime = meta.dateTime
+	}
+	return results
+}
+
+// insertResult records a parsed result as a new run in the environment's
+// database and returns the ID of the run. Failures to insert single results
+// are printed rather than returned, so that the rest of the run is kept.
+func (env *Environment) insertResult(results *Result, meta *runMetadata) (int64, error) {
+	runID, err := env.startRun(results, meta)
+	if err != nil {
+		return 0, err
+	}
+	if err := env.insertRunResults(runID, results, meta); err != nil {
+		return 0, err
+	}
+	if err := env.refreshDailyAggregates(results.dateTime); err != nil {
+		fmt.Println("Error refreshing duration summaries: ", err)
+	}
+	return runID, nil
+}
+
+// startRun records a new run at the commit hash and date time of results,
+// without any of its results, and returns the ID of the run. When meta gives
+// a checkout, the commit is read from it and the commit hash of results is
+// expanded.
+func (env *Environment) startRun(results *Result, meta *runMetadata) (int64, error) {
+	// The commit is read first, so that the run stores its full hash. A
+	// commit missing from the checkout only costs the run its commit
+	// metadata, rather than the run itself.
+	var commit *commitInfo
+	if meta != nil && meta.repo != "" {
+		c, err := readCommit(meta.repo, results.commitHash)
+		if err != nil {
+			fmt.Printf("Error reading commit %v, storing the run without its metadata: %v\n", results.commitHash, err)
+		} else {
+			commit = c
+			results.commitHash = c.hash
+		}
+	}
+
+	runID, err := env.insertRun(results.commitHash, results.dateTime, meta)
+	if err != nil {
+		return 0, fmt.Errorf("inserting run: %v", err)
+	}
+	if commit != nil {
+		if err := env.storeCommit(commit); err != nil {
+			fmt.Println("Error inserting commit: ", err)
+		}
+	}
+	return runID, nil
+}
+
+// insertRunResults records the test and package results of results as part
+// of the given run. Failures to insert single results are printed rather than
+// returned. Duration summaries are left for the caller to refresh.
+func (env *Environment) insertRunResults(runID int64, results *Result, meta *runMetadata) error {
+	var project sql.NullString
+	if meta != nil && meta.project != "" {
+		project = sql.NullString{String: meta.project, Valid: true}
+	}
+	testStmt, err := env.db.Prepare("INSERT tests SET runID=?,commitHash=?,dateTime=?,name=?,packageName=?,result=?,output=?,duration=?,project=?")
+	if err != nil {
+		return fmt.Errorf("preparing test insert statement: %v", err)
+	}
+	defer testStmt.Close()
+	packageStmt, err := env.db.Prepare("INSERT packages SET runID=?,commitHash=?,dateTime=?,name=?,result=?,duration=?,project=?")
+	if err != nil {
+		return fmt.Errorf("preparing package insert statement: %v", err)
+	}
+	defer packageStmt.Close()
 
 	for _, t := range results.testResults {
 		statusString := StatusStrings[int(t.result)]
-		_, err := testStmt.Exec(results.commitHash, results.dateTime, t.name, statusString, t.output, int(t.duration.Seconds()))
+		_, err := testStmt.Exec(runID, results.commitHash, results.dateTime, t.name, t.pkg, statusString, t.output, t.duration.Seconds(), project)
 		if err != nil {
 			fmt.Println("Error inserting test result: ", err)
 		}
@@ -32,16 +242,23 @@ func (env *Environment) InsertLogToDB(filename string) {
 
 	for _, m := range results.packageResults {
 		statusString := StatusStrings[int(m.result)] // MySql expects a string type for its enum.
-		_, err := packageStmt.Exec(results.commitHash, results.dateTime, m.name, statusString, int(m.duration.Seconds()))
+		_, err := packageStmt.Exec(runID, results.commitHash, results.dateTime, m.name, statusString, m.duration.Seconds(), project)
 		if err != nil {
 			fmt.Println("Error inserting package result: ", err)
 		}
 	}
+
+	if meta != nil && meta.owners != nil {
+		if err := env.insertRunOwners(runID, results, meta.owners); err != nil {
+			fmt.Println("Error inserting package owners: ", err)
+		}
+	}
+	return nil
 }
 
 // InsertLogsFromDirectory records data from the test logs in the given directory into the
 // environment's database.
-func (env *Environment) InsertLogsFromDirectory(dir string) {
+func (env *Environment) InsertLogsFromDirectory(dir string, meta *runMetadata) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		log.Fatal("Error reading directory: ", err)
@@ -50,17 +267,19 @@ func (env *Environment) InsertLogsFromDirectory(dir string) {
 		if f.IsDir() {
 			continue
 		}
-		env.InsertLogToDB(dir + f.Name())
+		env.InsertLogToDB(dir+f.Name(), meta)
 	}
 }
 
-// mostRecentCommitHash gets the most recent commit hash of any test stored in
-// the environment's databse.
-func (env *Environment) mostRecentCommitHash() string {
-	var hash string
-	err := env.db.QueryRow("select commitHash from tests order by datetime desc limit 1;").Scan(&hash)
-	if err != nil {
-		log.Fatal("Error getting commit hash: ", err)
+// mostRecentCommitHash gets the commit hash of the most recent run of the
+// profile's project and branch stored in the environment's databse, and the
+// branch that run is compared against: the profile's baseline branch, or else
+// the branch the run targets, or else its own. It returns sql.ErrNoRows if no
+// runs are stored.
+func (env *Environment) mostRecentCommitHash() (hash string, baselineBranch string, err error) {
+	err = env.db.QueryRow("select r.commitHash, coalesce(r.targetBranch, r.branch, '') from runs r where "+runScopeFilter+" order by r.dateTime desc, r.id desc limit 1;", env.scopeArgs()...).Scan(&hash, &baselineBranch)
+	if env.profile != nil && env.profile.BaselineBranch != "" {
+		baselineBranch = env.profile.BaselineBranch
 	}
-	return hash
+	return hash, baselineBranch, err
 }
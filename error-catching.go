@@ -2,40 +2,44 @@ package main
 
 import (
 	"database/sql"
-	"log"
 	"time"
 )
 
 // TestResult represents the information given from a single test fail.
 type failResult struct {
+	runID      int64
 	commitHash string
 	dateTime   time.Time
 	name       string
+	pkg        string
 	result     Status
 	output     string
 	duration   time.Duration
 }
 
-// failedTestsFromLastDay gets the data every test that failed in the last day.
-func (env *Environment) failedTestsFromLastDay() []*failResult {
-	rows, err := env.db.Query("select commitHash, dateTime, name, output, duration from tests where datetime between date_sub(now(), INTERVAL 1 day) and now() and result='FAILED';")
+// failedTestsFromWindow gets the data every test that failed within the
+// profile's window.
+func (env *Environment) failedTestsFromWindow() ([]*failResult, error) {
+	rows, err := env.db.Query("select runID, commitHash, dateTime, name, packageName, output, duration from tests where datetime between date_sub(now(), INTERVAL ? SECOND) and now() and result='FAILED' and "+scopeFilter+";", append([]interface{}{env.profile.Window.Seconds()}, env.scopeArgs()...)...)
 	if err != nil {
-		log.Fatal("Error selecting failed results: ", err)
+		return nil, err
 	}
 	var results []*failResult
 	defer rows.Close()
 	for rows.Next() {
 		// failResult fields:
 		var (
+			runID    sql.NullInt64
 			hash     sql.NullString
 			dateTime time.Time
 			name     sql.NullString
+			pkg      sql.NullString
 			output   sql.NullString
-			duration time.Duration
+			duration float64
 		)
-		err := rows.Scan(&hash, &dateTime, &name, &output, &duration)
+		err := rows.Scan(&runID, &hash, &dateTime, &name, &pkg, &output, &duration)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 
 		// SQL can return NULL types for strings. If we get a NULL string we
@@ -54,45 +58,83 @@ func (env *Environment) failedTestsFromLastDay() []*failResult {
 		}
 
 		fr := &failResult{
+			runID:      runID.Int64,
 			commitHash: safeHash,
 			dateTime:   dateTime,
 			name:       safeName,
+			pkg:        pkg.String,
 			result:     Status(FAILED),
 			output:     safeOutput,
-			duration:   duration,
+			duration:   secondsToDuration(duration),
 		}
 
 		results = append(results, fr)
 	}
-	err = rows.Err()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return results
+	return results, rows.Err()
 }
 
-// panicsFromLastDay gets the dateTime of every test run in the last day which has had a panic occur.
-func (env *Environment) panicsFromLastDay() []time.Time {
-	rows, err := env.db.Query("select dateTime from tests where datetime between date_sub(now(), INTERVAL 1 day) and now() and name='PANIC';")
+// panicResult identifies a test run in which a panic occured.
+type panicResult struct {
+	runID    int64
+	dateTime time.Time
+	pkg      string
+}
 
+// panicsFromWindow gets every test run within the profile's window which has
+// had a panic occur.
+func (env *Environment) panicsFromWindow() ([]*panicResult, error) {
+	rows, err := env.db.Query("select runID, dateTime, packageName from tests where datetime between date_sub(now(), INTERVAL ? SECOND) and now() and name='PANIC' and "+scopeFilter+";", append([]interface{}{env.profile.Window.Seconds()}, env.scopeArgs()...)...)
 	if err != nil {
-		log.Fatal("Error selecting panic results: ", err)
+		return nil, err
 	}
-	var results []time.Time
+	var results []*panicResult
 	defer rows.Close()
 	for rows.Next() {
+		var runID sql.NullInt64
 		var t time.Time
-		err := rows.Scan(&t)
+		var pkg sql.NullString
+		err := rows.Scan(&runID, &t, &pkg)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		results = append(results, t)
+		results = append(results, &panicResult{
+			runID:    runID.Int64,
+			dateTime: t,
+			pkg:      pkg.String,
+		})
 	}
-	err = rows.Err()
+	return results, rows.Err()
+}
+
+// raceMarker begins every report written by the race detector.
+const raceMarker = "WARNING: DATA RACE"
+
+// racesFromWindow gets every test within the profile's window whose output
+// holds a report from the race detector.
+func (env *Environment) racesFromWindow() ([]*failResult, error) {
+	rows, err := env.db.Query("select runID, commitHash, dateTime, name, packageName, result, output, duration from tests where datetime between date_sub(now(), INTERVAL ? SECOND) and now() and output like concat('%', ?, '%') and "+scopeFilter+" order by dateTime desc;", append([]interface{}{env.profile.Window.Seconds(), raceMarker}, env.scopeArgs()...)...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	return results
+	var results []*failResult
+	for rows.Next() {
+		var (
+			fr       failResult
+			pkg      sql.NullString
+			status   string
+			duration float64
+		)
+		if err := rows.Scan(&fr.runID, &fr.commitHash, &fr.dateTime, &fr.name, &pkg, &status, &fr.output, &duration); err != nil {
+			return nil, err
+		}
+		if fr.result, err = ParseStatus(status); err != nil {
+			return nil, err
+		}
+		fr.pkg = pkg.String
+		fr.duration = secondsToDuration(duration)
+		results = append(results, &fr)
+	}
+	return results, rows.Err()
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+
+	"github.com/marcinja/go-testdb/report"
+)
+
+// flakyTestsBetween finds tests that both passed and failed on the same commit
+// between from and to before now, most flaky first. A test's score is the
+// fraction of its consecutive results that flipped between passing and
+// failing.
+func (env *Environment) flakyTestsBetween(from, to Window) ([]*report.FlakyTest, error) {
+	rows, err := env.db.Query("select name, packageName, commitHash, result from tests where datetime between date_sub(now(), INTERVAL ? SECOND) and date_sub(now(), INTERVAL ? SECOND) and result in ('PASSED', 'FAILED') and name != ? and "+scopeFilter+" order by name, dateTime;", append([]interface{}{from.Seconds(), to.Seconds(), panicTestName}, env.scopeArgs()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type commitResults struct {
+		passed, failed bool
+	}
+	var (
+		flaky   []*report.FlakyTest
+		current *report.FlakyTest
+		flips   int
+		last    string
+		commits map[string]*commitResults
+	)
+	finish := func() {
+		if current == nil {
+			return
+		}
+		for _, c := range commits {
+			if c.passed && c.failed {
+				current.FlakyCommits++
+			}
+		}
+		if current.FlakyCommits > 0 {
+			if current.Runs > 1 {
+				current.Score = float64(flips) / float64(current.Runs-1)
+			}
+			flaky = append(flaky, current)
+		}
+	}
+
+	for rows.Next() {
+		var (
+			name, hash, result string
+			pkg                sql.NullString
+		)
+		if err := rows.Scan(&name, &pkg, &hash, &result); err != nil {
+			return nil, err
+		}
+		if current == nil || current.Name != name {
+			finish()
+			current = &report.FlakyTest{Name: name, Package: pkg.String}
+			flips, last = 0, ""
+			commits = make(map[string]*commitResults)
+		}
+
+		current.Runs++
+		c, ok := commits[hash]
+		if !ok {
+			c = &commitResults{}
+			commits[hash] = c
+		}
+		if result == StatusStrings[FAILED] {
+			current.Failures++
+			c.failed = true
+		} else {
+			c.passed = true
+		}
+		if last != "" && last != result {
+			flips++
+		}
+		last = result
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	finish()
+
+	sort.SliceStable(flaky, func(i, j int) bool {
+		return flaky[i].Score > flaky[j].Score
+	})
+	return flaky, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSubjectLength is the number of bytes of a commit subject stored.
+const maxSubjectLength = 500
+
+// commitHashPattern matches a commit hash, which may be abbreviated.
+var commitHashPattern = regexp.MustCompile(`^[0-9a-f]{4,40}$`)
+
+// checkCommitHash returns an error if hash isn't a commit hash, so that
+// nothing else, such as an option, is handed to git in its place.
+func checkCommitHash(hash string) error {
+	if !commitHashPattern.MatchString(hash) {
+		return fmt.Errorf("invalid commit hash %q", hash)
+	}
+	return nil
+}
+
+// commitInfo is the metadata of a commit, read from a git checkout.
+type commitInfo struct {
+	hash      string
+	author    string
+	committed time.Time
+	subject   string
+	parents   []string
+
+	// files are the paths changed by the commit, relative to the root of
+	// the checkout. Merges list the paths changed from their first parent.
+	files []string
+
+	// generation is the number of commits reachable from the commit,
+	// including itself, so that every commit has a higher generation than
+	// its ancestors.
+	generation int64
+}
+
+// gitOutput runs git in the checkout at repo and returns its standard output.
+// Callers put "--end-of-options" before any revision given to them, so that
+// one starting with "-" can't be read as an option.
+func gitOutput(repo string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %v: %v", args[0], msg)
+		}
+		return "", fmt.Errorf("git %v: %v", args[0], err)
+	}
+	return string(out), nil
+}
+
+// readCommit reads the metadata of the commit with the given hash, which may
+// be abbreviated, from the git checkout at repo.
+func readCommit(repo, hash string) (*commitInfo, error) {
+	out, err := gitOutput(repo, "log", "-1", "--format=%H%x00%an <%ae>%x00%cI%x00%P%x00%s", "--end-of-options", hash, "--")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.SplitN(strings.TrimSuffix(out, "\n"), "\x00", 5)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("unexpected git log output for %v", hash)
+	}
+	c := &commitInfo{
+		hash:    fields[0],
+		author:  fields[1],
+		parents: strings.Fields(fields[3]),
+		subject: fields[4],
+	}
+	if c.committed, err = time.Parse(time.RFC3339, fields[2]); err != nil {
+		return nil, fmt.Errorf("bad committer date of %v: %v", c.hash, err)
+	}
+
+	var files string
+	if len(c.parents) == 0 {
+		files, err = gitOutput(repo, "diff-tree", "--no-commit-id", "--name-only", "-r", "-z", "--root", "--end-of-options", c.hash)
+	} else {
+		files, err = gitOutput(repo, "diff", "--name-only", "-z", "--end-of-options", c.parents[0], c.hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range strings.Split(files, "\x00") {
+		if f != "" {
+			c.files = append(c.files, f)
+		}
+	}
+
+	count, err := gitOutput(repo, "rev-list", "--count", "--end-of-options", c.hash)
+	if err != nil {
+		return nil, err
+	}
+	if c.generation, err = strconv.ParseInt(strings.TrimSpace(count), 10, 64); err != nil {
+		return nil, fmt.Errorf("bad commit count of %v: %v", c.hash, err)
+	}
+	return c, nil
+}
+
+// storeCommit records a commit's metadata, parents and changed files, unless
+// the commit is already stored. They are stored in one transaction, so that a
+// commit is never stored without its parents and files.
+func (env *Environment) storeCommit(c *commitInfo) error {
+	tx, err := env.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT IGNORE commits SET hash=?,author=?,committedAt=?,subject=?,generation=?", c.hash, c.author, c.committed, truncateUTF8(c.subject, maxSubjectLength), c.generation)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	for i, parent := range c.parents {
+		if _, err := tx.Exec("INSERT commitParents SET hash=?,parent=?,position=?", c.hash, parent, i); err != nil {
+			return err
+		}
+	}
+	for _, f := range c.files {
+		if _, err := tx.Exec("INSERT commitFiles SET hash=?,path=?", c.hash, f); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// storedCommit returns the stored metadata of the commit with the given hash,
+// or nil if none is stored.
+func (env *Environment) storedCommit(hash string) (*commitInfo, error) {
+	c := &commitInfo{hash: hash}
+	err := env.db.QueryRow("select author, committedAt, subject, generation from commits where hash = ?;", hash).Scan(&c.author, &c.committed, &c.subject, &c.generation)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := env.db.Query("select parent from commitParents where hash = ? order by position;", hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var parent string
+		if err := rows.Scan(&parent); err != nil {
+			return nil, err
+		}
+		c.parents = append(c.parents, parent)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	files, err := env.db.Query("select path from commitFiles where hash = ? order by path;", hash)
+	if err != nil {
+		return nil, err
+	}
+	defer files.Close()
+	for files.Next() {
+		var f string
+		if err := files.Scan(&f); err != nil {
+			return nil, err
+		}
+		c.files = append(c.files, f)
+	}
+	return c, files.Err()
+}
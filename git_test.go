@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckCommitHash(t *testing.T) {
+	for _, hash := range []string{"abcd", "0123456789abcdef0123456789abcdef01234567"} {
+		if err := checkCommitHash(hash); err != nil {
+			t.Errorf("checkCommitHash(%q) = %v, want nil", hash, err)
+		}
+	}
+	for _, hash := range []string{"", "abc", "--output=/tmp/x", "ABCDEF", "abcd efgh", "0123456789abcdef0123456789abcdef012345678"} {
+		if err := checkCommitHash(hash); err == nil {
+			t.Errorf("checkCommitHash(%q) succeeded, want an error", hash)
+		}
+	}
+}
+
+func TestReadCommitOption(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	repo := t.TempDir()
+	if _, err := gitOutput(repo, "init", "-q"); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	if _, err := readCommit(repo, "--output="+out); err == nil {
+		t.Error("reading an option as a commit succeeded, want an error")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("git wrote the file named by an option given as a commit")
+	}
+	if _, _, err := changedFilesBetween(repo, "--output="+out, "HEAD"); err == nil {
+		t.Error("listing changes from an option succeeded, want an error")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("git wrote the file named by an option given as a revision")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+
+	"github.com/marcinja/go-testdb/report"
+)
+
+// Sizes, in pixels, of the charts in the HTML report.
+const (
+	sparklineWidth  = 160
+	sparklineHeight = 32
+	outcomeBarWidth = 14
+	outcomeHeight   = 120
+)
+
+// sparkline draws the given values as an inline SVG line chart, with the last
+// value marked.
+func sparkline(values []float64) template.HTML {
+	if len(values) == 0 {
+		return ""
+	}
+	min, max := values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	span := max - min
+	if span == 0 {
+		span = 1
+	}
+
+	const pad = 2
+	var points []string
+	var lastX, lastY float64
+	for i, v := range values {
+		x := float64(pad)
+		if len(values) > 1 {
+			x += float64(i) * float64(sparklineWidth-2*pad) / float64(len(values)-1)
+		}
+		y := float64(pad) + (1-(v-min)/span)*float64(sparklineHeight-2*pad)
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+		lastX, lastY = x, y
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="sparkline" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="durations from %.2fs to %.2fs">`, sparklineWidth, sparklineHeight, sparklineWidth, sparklineHeight, min, max)
+	fmt.Fprintf(&b, `<polyline fill="none" stroke="#3b6ea5" stroke-width="1.5" points="%s"/>`, strings.Join(points, " "))
+	fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="2.5" fill="#c0392b"/>`, lastX, lastY)
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// outcomeChart draws a stacked bar for each run showing how many tests
+// passed, failed, were skipped and were undetermined. Each bar links to the
+// run's section of the report.
+func outcomeChart(runs []*report.Run) template.HTML {
+	return linkedOutcomeChart(runs, func(id int64) string { return fmt.Sprintf("#run-%d", id) })
+}
+
+// linkedOutcomeChart is outcomeChart with each bar linking to href(run ID).
+func linkedOutcomeChart(runs []*report.Run, href func(id int64) string) template.HTML {
+	if len(runs) == 0 {
+		return ""
+	}
+	var max int
+	for _, r := range runs {
+		if total := r.Passed + r.Failed + r.Skipped + r.Undetermined; total > max {
+			max = total
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+
+	width := len(runs) * (outcomeBarWidth + 2)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="outcomes" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="test outcomes per run">`, width, outcomeHeight, width, outcomeHeight)
+	for i, r := range runs {
+		x := i * (outcomeBarWidth + 2)
+		y := float64(outcomeHeight)
+		fmt.Fprintf(&b, `<a href="%s"><title>run %d: %d passed, %d failed, %d skipped, %d undetermined</title>`, template.HTMLEscapeString(href(r.ID)), r.ID, r.Passed, r.Failed, r.Skipped, r.Undetermined)
+		for _, seg := range []struct {
+			n     int
+			color string
+		}{
+			{r.Passed, "#2e8b57"},
+			{r.Skipped, "#c8a951"},
+			{r.Undetermined, "#8e7cc3"},
+			{r.Failed, "#c0392b"},
+		} {
+			h := float64(seg.n) / float64(max) * float64(outcomeHeight)
+			y -= h
+			fmt.Fprintf(&b, `<rect x="%d" y="%.1f" width="%d" height="%.1f" fill="%s"/>`, x, y, outcomeBarWidth, h, seg.color)
+		}
+		b.WriteString(`</a>`)
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
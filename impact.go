@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marcinja/go-testdb/report"
+)
+
+// maxImpactEvidence is the number of changed files reported for each newly
+// failing test.
+const maxImpactEvidence = 10
+
+// Impact verdicts.
+const (
+	verdictRegression = "regression"
+	verdictFlake      = "flake"
+)
+
+// importGraph is the import graph of the packages in a checkout, as listed by
+// go list.
+type importGraph struct {
+	// packages maps the directory of each package in the checkout, relative
+	// to its root, to the package's import path.
+	packages map[string]string
+
+	// imports maps import paths to the import paths they import, and
+	// testImports to those only their tests import. Only a package's own
+	// tests are affected by its test imports, so they aren't followed
+	// further.
+	imports     map[string][]string
+	testImports map[string][]string
+}
+
+// importGraphFormat is the go list template giving a package's import path,
+// the package it was recompiled for the test of, if any, its directory, its
+// imports and its tests' imports on one line. Imports are separated by commas,
+// since packages recompiled for a test are listed as "path [pkg.test]".
+const importGraphFormat = "{{if not .Standard}}{{.ImportPath}}\t{{.ForTest}}\t{{.Dir}}\t{{join .Imports \",\"}}\t{{join .TestImports \",\"}},{{join .XTestImports \",\"}}{{end}}"
+
+// testVariantPath returns the import path of a package as listed by go list
+// -test, without the " [pkg.test]" of packages recompiled for a test.
+func testVariantPath(importPath string) string {
+	if i := strings.Index(importPath, " ["); i >= 0 {
+		return importPath[:i]
+	}
+	return importPath
+}
+
+// splitImports splits a comma separated list of imports listed by go list.
+func splitImports(list string) []string {
+	var imports []string
+	for _, imp := range strings.Split(list, ",") {
+		if imp != "" {
+			imports = append(imports, testVariantPath(imp))
+		}
+	}
+	return imports
+}
+
+// loadImportGraph lists the packages of the checkout at repo, and their
+// dependencies and those of their tests, with go list.
+func loadImportGraph(repo string) (*importGraph, error) {
+	top, err := gitOutput(repo, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root, err := filepath.EvalSymlinks(strings.TrimSpace(top))
+	if err != nil {
+		return nil, err
+	}
+
+	// -test lists the dependencies of test imports as well.
+	cmd := exec.Command("go", "list", "-e", "-deps", "-test", "-f", importGraphFormat, "./...")
+	cmd.Dir = repo
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	g := &importGraph{packages: make(map[string]string), imports: make(map[string][]string), testImports: make(map[string][]string)}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.SplitN(line, "\t", 5)
+		if len(fields) != 5 {
+			continue
+		}
+		importPath, forTest, dir := fields[0], fields[1], fields[2]
+		// The generated main package of a test, "pkg.test", imports the
+		// packages recompiled for it, listed as "path [pkg.test]".
+		if forTest == "" && strings.Contains(fields[3], " ["+importPath+"]") {
+			continue
+		}
+		if forTest != "" {
+			// A package recompiled for a test imports what it always
+			// does, so it is only kept if it isn't listed as itself. The
+			// package under test and its external test package, though,
+			// include their test imports.
+			importPath = testVariantPath(importPath)
+			if _, ok := g.imports[importPath]; ok || importPath == forTest || importPath == forTest+"_test" {
+				continue
+			}
+		} else {
+			g.testImports[importPath] = splitImports(fields[4])
+		}
+		g.imports[importPath] = splitImports(fields[3])
+		if dir == "" {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = resolved
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		g.packages[filepath.ToSlash(rel)] = importPath
+	}
+	return g, nil
+}
+
+// lookup returns the import path of the stored package name pkg, which may
+// have had a package prefix trimmed, or "" if it isn't in the checkout.
+func (g *importGraph) lookup(pkg string) string {
+	var match string
+	for _, importPath := range g.packages {
+		if importPath == pkg {
+			return importPath
+		}
+		if strings.HasSuffix(importPath, "/"+pkg) && (match == "" || len(importPath) < len(match)) {
+			match = importPath
+		}
+	}
+	return match
+}
+
+// distances returns the number of imports between pkg, with its tests, and
+// each package they depend on, 0 for pkg itself. The tests of the packages pkg
+// depends on don't count.
+func (g *importGraph) distances(pkg string) map[string]int {
+	dist := map[string]int{pkg: 0}
+	var queue []string
+	for _, imps := range [][]string{g.imports[pkg], g.testImports[pkg]} {
+		for _, imp := range imps {
+			if _, ok := dist[imp]; !ok {
+				dist[imp] = 1
+				queue = append(queue, imp)
+			}
+		}
+	}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, imp := range g.imports[p] {
+			if _, ok := dist[imp]; !ok {
+				dist[imp] = dist[p] + 1
+				queue = append(queue, imp)
+			}
+		}
+	}
+	return dist
+}
+
+// changedFile is a file changed by a commit.
+type changedFile struct {
+	path    string
+	commit  string
+	subject string
+}
+
+// changedFilesBetween returns the files changed by the commits reachable from
+// to but not from, newest change of each file first, and the number of those
+// commits.
+func changedFilesBetween(repo, from, to string) ([]changedFile, int, error) {
+	out, err := gitOutput(repo, "log", "--format=%x00%H%x00%s", "--name-only", "--end-of-options", from+".."+to, "--")
+	if err != nil {
+		return nil, 0, err
+	}
+	var files []changedFile
+	seen := make(map[string]bool)
+	fields := strings.Split(out, "\x00")
+	commits := 0
+	for i := 1; i+1 < len(fields); i += 2 {
+		commits++
+		lines := strings.Split(fields[i+1], "\n")
+		for _, p := range lines[1:] {
+			if p == "" || seen[p] {
+				continue
+			}
+			seen[p] = true
+			files = append(files, changedFile{path: p, commit: fields[i], subject: lines[0]})
+		}
+	}
+	return files, commits, nil
+}
+
+// evidence returns how a changed file could affect the package with the
+// given distances from the failing test's package, or nil if it couldn't.
+func (g *importGraph) evidence(f changedFile, testPkg string, dist map[string]int) *report.ImpactEvidence {
+	e := &report.ImpactEvidence{Path: f.path, Commit: f.commit, Subject: f.subject}
+	base := path.Base(f.path)
+	if base == "go.mod" || base == "go.sum" {
+		e.Score = 0.25
+		e.Reason = "changes module requirements"
+		return e
+	}
+
+	// Files belong to the package of their directory, and files in other
+	// directories, such as testdata, to the package above them.
+	dir := path.Dir(f.path)
+	for d := dir; ; d = path.Dir(d) {
+		if p, ok := g.packages[d]; ok {
+			distance, ok := dist[p]
+			if !ok {
+				return nil
+			}
+			e.Package, e.Distance = p, distance
+			switch {
+			case d != dir:
+				e.Score = 0.9 / float64(distance+1)
+				e.Reason = fmt.Sprintf("changes files under %v", p)
+			case distance == 0:
+				e.Score = 1
+				e.Reason = "changes the test's package"
+			case distance == 1:
+				e.Score = 0.5
+				e.Reason = fmt.Sprintf("changes %v, which %v imports", p, testPkg)
+			default:
+				e.Score = 1 / float64(distance+1)
+				e.Reason = fmt.Sprintf("changes %v, which %v imports indirectly, %d imports away", p, testPkg, distance)
+			}
+			return e
+		}
+		if d == "." {
+			return nil
+		}
+	}
+}
+
+// lastPassBefore returns the commit hash of the most recent passing result of
+// the named test of the given package before the given time, or "" if it
+// never passed.
+func (env *Environment) lastPassBefore(pkg, name string, before time.Time) (string, error) {
+	var hash string
+	err := env.db.QueryRow("select commitHash from tests where coalesce(packageName, '') = ? and name = ? and result='PASSED' and dateTime < ? and "+scopeFilter+" order by dateTime desc limit 1;", append([]interface{}{pkg, name, before}, env.scopeArgs()...)...).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+// reportImpacts links each failing test that passed before its first failure
+// in the window to the changes made since, using the git history and import
+// graph of the checkout at repo. The import graph is that of the checkout as
+// it is now, not at the failing commit. Tests whose changes can't be read,
+// such as when the checkout is missing a commit, are logged and left out.
+func (env *Environment) reportImpacts(failures []*report.Failure, repo string) ([]*report.Impact, error) {
+	first := make(map[testID]*report.Failure)
+	var keys []testID
+	for _, f := range failures {
+		k := testID{f.Package, f.Name}
+		if prev, ok := first[k]; !ok || f.DateTime.Before(prev.DateTime) {
+			if !ok {
+				keys = append(keys, k)
+			}
+			first[k] = f
+		}
+	}
+	sortTestIDs(keys)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	g, err := loadImportGraph(repo)
+	if err != nil {
+		return nil, err
+	}
+	var impacts []*report.Impact
+	for _, k := range keys {
+		f := first[k]
+		lastPass, err := env.lastPassBefore(k.pkg, k.name, f.DateTime)
+		if err != nil {
+			return nil, err
+		}
+		if lastPass == "" {
+			continue
+		}
+		impact := &report.Impact{
+			Name:           f.Name,
+			Package:        f.Package,
+			FailingCommit:  f.CommitHash,
+			LastPassCommit: lastPass,
+			Verdict:        verdictFlake,
+			Evidence:       []*report.ImpactEvidence{},
+		}
+		if lastPass == f.CommitHash {
+			impacts = append(impacts, impact)
+			continue
+		}
+
+		files, commits, err := changedFilesBetween(repo, lastPass, f.CommitHash)
+		if err != nil {
+			log.Printf("Skipping impact of changes on %v: %v", f.Name, err)
+			continue
+		}
+		impacts = append(impacts, impact)
+		impact.Commits = commits
+		testPkg := g.lookup(f.Package)
+		dist := g.distances(testPkg)
+		for _, file := range files {
+			if e := g.evidence(file, testPkg, dist); e != nil {
+				impact.Evidence = append(impact.Evidence, e)
+			}
+		}
+		sort.SliceStable(impact.Evidence, func(i, j int) bool { return impact.Evidence[i].Score > impact.Evidence[j].Score })
+		if len(impact.Evidence) > maxImpactEvidence {
+			impact.Evidence = impact.Evidence[:maxImpactEvidence]
+		}
+		if len(impact.Evidence) > 0 {
+			impact.Verdict = verdictRegression
+		}
+	}
+	return impacts, nil
+}
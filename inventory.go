@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sort"
+)
+
+// inventoryCounts holds how many times a test was run and skipped.
+type inventoryCounts struct {
+	runs    int
+	skipped int
+}
+
+// skipJump describes a test that was skipped much more often in the window
+// than during the baseline.
+type skipJump struct {
+	testID
+	baselineRate float64
+	recentRate   float64
+}
+
+// inventoryChanges describes how the set of tests and packages run within the
+// profile's window differs from the set run during the rest of the baseline.
+type inventoryChanges struct {
+	vanishedTests    []testID
+	vanishedPackages []string
+	newTests         []testID
+	skipJumps        []*skipJump
+}
+
+// inventoryChangesFromBaseline compares the tests and packages run within the
+// profile's window against those run earlier in the baseline window, so that
+// renamed, deleted or no longer built tests don't go unnoticed. Tests are only
+// reported as vanished from packages that ran within the window, so that a run
+// of a few packages doesn't make the tests of every other package look gone.
+func (env *Environment) inventoryChangesFromBaseline() (*inventoryChanges, error) {
+	p := env.profile
+	recentTests, err := env.testCountsBetween(p.Window, 0)
+	if err != nil {
+		return nil, err
+	}
+	baselineTests, err := env.testCountsBetween(p.Baseline, p.Window)
+	if err != nil {
+		return nil, err
+	}
+	recentPackages, err := env.packageNamesBetween(p.Window, 0)
+	if err != nil {
+		return nil, err
+	}
+	baselinePackages, err := env.packageNamesBetween(p.Baseline, p.Window)
+	if err != nil {
+		return nil, err
+	}
+	return compareInventories(recentTests, baselineTests, recentPackages, baselinePackages, p.SkipRateJump), nil
+}
+
+// compareInventories compares the tests and packages run recently against
+// those run during the baseline. Tests whose skip rate grew by at least
+// skipRateJump are reported as skip jumps.
+func compareInventories(recentTests, baselineTests map[testID]inventoryCounts, recentPackages, baselinePackages map[string]struct{}, skipRateJump float64) *inventoryChanges {
+	changes := &inventoryChanges{}
+	// Without any recent results every test would look like it vanished, when
+	// really nothing has been run yet.
+	if len(recentTests) == 0 || len(baselineTests) == 0 {
+		return changes
+	}
+
+	for t, recent := range recentTests {
+		baseline, ok := baselineTests[t]
+		if !ok {
+			changes.newTests = append(changes.newTests, t)
+			continue
+		}
+		baselineRate := float64(baseline.skipped) / float64(baseline.runs)
+		recentRate := float64(recent.skipped) / float64(recent.runs)
+		if recentRate-baselineRate >= skipRateJump {
+			changes.skipJumps = append(changes.skipJumps, &skipJump{
+				testID:       t,
+				baselineRate: baselineRate,
+				recentRate:   recentRate,
+			})
+		}
+	}
+	// A package ran if its result or any of its tests was stored, and tests
+	// stored without a package are compared if any of them ran.
+	ranRecently := make(map[string]bool)
+	for name := range recentPackages {
+		ranRecently[name] = true
+	}
+	for t := range recentTests {
+		ranRecently[t.pkg] = true
+	}
+	for t := range baselineTests {
+		if _, ok := recentTests[t]; !ok && ranRecently[t.pkg] {
+			changes.vanishedTests = append(changes.vanishedTests, t)
+		}
+	}
+	for name := range baselinePackages {
+		if _, ok := recentPackages[name]; !ok {
+			changes.vanishedPackages = append(changes.vanishedPackages, name)
+		}
+	}
+
+	sortTestIDs(changes.vanishedTests)
+	sort.Strings(changes.vanishedPackages)
+	sortTestIDs(changes.newTests)
+	sort.Slice(changes.skipJumps, func(i, j int) bool {
+		return changes.skipJumps[i].less(changes.skipJumps[j].testID)
+	})
+	return changes
+}
+
+// testCountsBetween returns the number of runs and skips of each test stored
+// between from and to before now. Panics are not counted as tests.
+func (env *Environment) testCountsBetween(from, to Window) (map[testID]inventoryCounts, error) {
+	rows, err := env.db.Query("select coalesce(packageName, ''), name, count(*), sum(result='SKIPPED') from tests where datetime between date_sub(now(), INTERVAL ? SECOND) and date_sub(now(), INTERVAL ? SECOND) and name != ? and "+scopeFilter+" group by packageName, name;", append([]interface{}{from.Seconds(), to.Seconds(), panicTestName}, env.scopeArgs()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[testID]inventoryCounts)
+	for rows.Next() {
+		var t testID
+		var c inventoryCounts
+		if err := rows.Scan(&t.pkg, &t.name, &c.runs, &c.skipped); err != nil {
+			return nil, err
+		}
+		counts[t] = c
+	}
+	return counts, rows.Err()
+}
+
+// packageNamesBetween returns the set of packages stored between from and to
+// before now.
+func (env *Environment) packageNamesBetween(from, to Window) (map[string]struct{}, error) {
+	rows, err := env.db.Query("select name from packages where datetime between date_sub(now(), INTERVAL ? SECOND) and date_sub(now(), INTERVAL ? SECOND) and "+scopeFilter+" group by name;", append([]interface{}{from.Seconds(), to.Seconds()}, env.scopeArgs()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[string]struct{})
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names[name] = struct{}{}
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareInventories(t *testing.T) {
+	renterTest := testID{"modules/renter", "TestUpload"}
+	hostTest := testID{"modules/host", "TestUpload"}
+	hostOther := testID{"modules/host", "TestStorage"}
+	walletTest := testID{"modules/wallet", "TestSend"}
+	newTest := testID{"modules/host", "TestNew"}
+
+	baselineTests := map[testID]inventoryCounts{
+		renterTest: {runs: 10},
+		hostTest:   {runs: 10},
+		hostOther:  {runs: 10},
+		walletTest: {runs: 10, skipped: 1},
+	}
+	baselinePackages := map[string]struct{}{"modules/renter": {}, "modules/host": {}, "modules/wallet": {}}
+
+	// Only the host package ran recently: its same-named test is still
+	// running, TestStorage is gone, and the renter and wallet tests aren't
+	// reported since their packages didn't run.
+	recentTests := map[testID]inventoryCounts{
+		hostTest: {runs: 2, skipped: 2},
+		newTest:  {runs: 2},
+	}
+	recentPackages := map[string]struct{}{"modules/host": {}}
+
+	changes := compareInventories(recentTests, baselineTests, recentPackages, baselinePackages, 0.5)
+	if want := []testID{hostOther}; !reflect.DeepEqual(changes.vanishedTests, want) {
+		t.Errorf("vanished tests = %v, want %v", changes.vanishedTests, want)
+	}
+	if want := []testID{newTest}; !reflect.DeepEqual(changes.newTests, want) {
+		t.Errorf("new tests = %v, want %v", changes.newTests, want)
+	}
+	if want := []string{"modules/renter", "modules/wallet"}; !reflect.DeepEqual(changes.vanishedPackages, want) {
+		t.Errorf("vanished packages = %v, want %v", changes.vanishedPackages, want)
+	}
+	if len(changes.skipJumps) != 1 || changes.skipJumps[0].testID != hostTest {
+		t.Errorf("skip jumps = %v, want %v", changes.skipJumps, hostTest)
+	}
+}
+
+func TestCompareInventoriesNothingRecent(t *testing.T) {
+	baselineTests := map[testID]inventoryCounts{{"modules/host", "TestUpload"}: {runs: 1}}
+	changes := compareInventories(nil, baselineTests, nil, map[string]struct{}{"modules/host": {}}, 0.5)
+	if len(changes.vanishedTests) != 0 || len(changes.vanishedPackages) != 0 {
+		t.Errorf("changes = %+v, want none without recent results", changes)
+	}
+}
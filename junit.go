@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The JUnit XML layout, as understood by most CI systems and IDEs.
+type (
+	junitTestSuites struct {
+		XMLName xml.Name         `xml:"testsuites"`
+		Suites  []junitTestSuite `xml:"testsuite"`
+	}
+
+	junitTestSuite struct {
+		Name       string          `xml:"name,attr"`
+		Tests      int             `xml:"tests,attr"`
+		Failures   int             `xml:"failures,attr"`
+		Errors     int             `xml:"errors,attr"`
+		Skipped    int             `xml:"skipped,attr"`
+		Time       string          `xml:"time,attr"`
+		Timestamp  string          `xml:"timestamp,attr,omitempty"`
+		Properties []junitProperty `xml:"properties>property,omitempty"`
+		TestCases  []junitTestCase `xml:"testcase"`
+	}
+
+	junitProperty struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	}
+
+	junitTestCase struct {
+		Name      string        `xml:"name,attr"`
+		Classname string        `xml:"classname,attr"`
+		Time      string        `xml:"time,attr"`
+		Failure   *junitMessage `xml:"failure,omitempty"`
+		Error     *junitMessage `xml:"error,omitempty"`
+		Skipped   *junitMessage `xml:"skipped,omitempty"`
+	}
+
+	junitMessage struct {
+		Message  string `xml:"message,attr,omitempty"`
+		Contents string `xml:",chardata"`
+	}
+)
+
+// Names of the suite properties used to carry run information.
+const (
+	junitCommitProperty = "commitHash"
+	junitRunProperty    = "runID"
+)
+
+// junitCommitProperties are the suite properties a commit hash is read from,
+// in order of preference.
+var junitCommitProperties = []string{junitCommitProperty, "commit", "git.commit", "vcs.revision"}
+
+// undeterminedMessage is the error message given to tests that never
+// completed.
+const undeterminedMessage = "test did not complete"
+
+// junitTimestamp is the layout of the JUnit timestamp attribute.
+const junitTimestamp = "2006-01-02T15:04:05"
+
+// unknownPackage is the suite name used for tests stored without a package.
+const unknownPackage = "unknown"
+
+// formatJUnitSeconds formats a number of seconds for a time attribute.
+func formatJUnitSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', 3, 64)
+}
+
+// runToJUnit converts a stored run into JUnit suites, one per package, named
+// by the package's import path: its stored name after the given prefix.
+func runToJUnit(r *run, tests []*TestResult, packages []*PackageResult, packagePrefix string) *junitTestSuites {
+	suites := make(map[string]*junitTestSuite)
+	suite := func(pkg string) *junitTestSuite {
+		name := packagePrefix + pkg
+		if pkg == "" {
+			name = unknownPackage
+		}
+		s, ok := suites[name]
+		if !ok {
+			s = &junitTestSuite{
+				Name:      name,
+				Time:      formatJUnitSeconds(0),
+				Timestamp: r.dateTime.Format(junitTimestamp),
+				Properties: []junitProperty{
+					{Name: junitCommitProperty, Value: r.commitHash},
+					{Name: junitRunProperty, Value: strconv.FormatInt(r.id, 10)},
+				},
+			}
+			suites[name] = s
+		}
+		return s
+	}
+
+	for _, p := range packages {
+		suite(p.name).Time = formatJUnitSeconds(p.duration.Seconds())
+	}
+	for _, t := range tests {
+		s := suite(t.pkg)
+		tc := junitTestCase{
+			Name:      t.name,
+			Classname: s.Name,
+			Time:      formatJUnitSeconds(t.duration.Seconds()),
+		}
+		switch {
+		case t.name == panicTestName:
+			tc.Error = &junitMessage{Message: "panic", Contents: t.output}
+			s.Errors++
+		case t.result == FAILED:
+			tc.Failure = &junitMessage{Message: "failed", Contents: t.output}
+			s.Failures++
+		case t.result == SKIPPED:
+			tc.Skipped = &junitMessage{Message: "skipped", Contents: t.output}
+			s.Skipped++
+		case t.result == UNDETERMINED:
+			tc.Error = &junitMessage{Message: undeterminedMessage}
+			s.Errors++
+		}
+		s.Tests++
+		s.TestCases = append(s.TestCases, tc)
+	}
+
+	var names []string
+	for name := range suites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := &junitTestSuites{}
+	for _, name := range names {
+		out.Suites = append(out.Suites, *suites[name])
+	}
+	return out
+}
+
+// ParseJUnit parses JUnit XML, such as that written by go-junit-report and
+// gotestsum, from r into a Result. The root element may be either
+// <testsuites> or a single <testsuite>, and each <testsuite> is read as a
+// package. The commit hash and date time come from meta when set, and
+// otherwise from the suites' properties and timestamps.
+func ParseJUnit(r io.Reader, meta *runMetadata) (*Result, error) {
+	suites, err := decodeJUnit(r)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		meta = &runMetadata{}
+	}
+
+	results := &Result{commitHash: meta.commitHash, dateTime: meta.dateTime}
+	for _, s := range suites {
+		if results.commitHash == "" {
+			results.commitHash = s.property(junitCommitProperties...)
+		}
+		if meta.dateTime.IsZero() && s.Timestamp != "" {
+			t, err := parseJUnitTimestamp(s.Timestamp)
+			if err != nil {
+				return nil, fmt.Errorf("suite %s: %v", s.Name, err)
+			}
+			if results.dateTime.IsZero() || t.Before(results.dateTime) {
+				results.dateTime = t
+			}
+		}
+
+		pkg := s.Name
+		packageResult := &PackageResult{name: pkg, result: PASSED}
+		if packageResult.duration, err = parseJUnitSeconds(s.Time); err != nil {
+			return nil, fmt.Errorf("suite %s: %v", s.Name, err)
+		}
+		for _, tc := range s.TestCases {
+			t := &TestResult{name: tc.Name, pkg: pkg, result: PASSED}
+			if t.duration, err = parseJUnitSeconds(tc.Time); err != nil {
+				return nil, fmt.Errorf("test %s: %v", tc.Name, err)
+			}
+			switch {
+			case tc.Error != nil && tc.Error.Message == undeterminedMessage:
+				t.result = UNDETERMINED
+			case tc.Failure != nil:
+				t.result, t.output = FAILED, tc.Failure.output()
+			case tc.Error != nil:
+				t.result, t.output = FAILED, tc.Error.output()
+			case tc.Skipped != nil:
+				t.result, t.output = SKIPPED, tc.Skipped.output()
+			}
+			if t.result == FAILED || t.result == UNDETERMINED {
+				packageResult.result = FAILED
+			}
+			results.testResults = append(results.testResults, t)
+		}
+		results.packageResults = append(results.packageResults, packageResult)
+	}
+	return results, nil
+}
+
+// decodeJUnit decodes the suites in JUnit XML from r.
+func decodeJUnit(r io.Reader) ([]junitTestSuite, error) {
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no <testsuites> or <testsuite> element")
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "testsuites":
+			var suites junitTestSuites
+			if err := dec.DecodeElement(&suites, &start); err != nil {
+				return nil, err
+			}
+			return suites.Suites, nil
+		case "testsuite":
+			var suite junitTestSuite
+			if err := dec.DecodeElement(&suite, &start); err != nil {
+				return nil, err
+			}
+			return []junitTestSuite{suite}, nil
+		default:
+			return nil, fmt.Errorf("unexpected root element <%s>", start.Name.Local)
+		}
+	}
+}
+
+// property returns the value of the first of the named properties the suite
+// has, or "" if it has none of them.
+func (s *junitTestSuite) property(names ...string) string {
+	for _, name := range names {
+		for _, p := range s.Properties {
+			if p.Name == name && p.Value != "" {
+				return p.Value
+			}
+		}
+	}
+	return ""
+}
+
+// output returns a message's contents, or its message attribute if it has no
+// contents.
+func (m *junitMessage) output() string {
+	if strings.TrimSpace(m.Contents) != "" {
+		return m.Contents
+	}
+	return m.Message
+}
+
+// parseJUnitSeconds parses a time attribute. A missing time is zero.
+func parseJUnitSeconds(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	// Some writers group thousands, e.g. "1,234.5".
+	seconds, err := strconv.ParseFloat(strings.Replace(s, ",", "", -1), 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return secondsToDuration(seconds), nil
+}
+
+// parseJUnitTimestamp parses a timestamp attribute, which may or may not
+// include a time zone.
+func parseJUnitTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(junitTimestamp, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad timestamp %q", s)
+	}
+	return t, nil
+}
+
+// RunJUnit returns the run referred to by ref as JUnit suites, giving its
+// packages the package prefix of the run's project in cfg, or
+// defaultPackagePrefix if it has no project.
+func (env *Environment) RunJUnit(ref string, cfg *Config) (*junitTestSuites, error) {
+	r, err := env.resolveRun(ref)
+	if err != nil {
+		return nil, err
+	}
+	tests, err := env.runTestResults(r.id)
+	if err != nil {
+		return nil, err
+	}
+	packages, err := env.runPackageResults(r.id)
+	if err != nil {
+		return nil, err
+	}
+	prefix := defaultPackagePrefix
+	if r.project != "" {
+		prefix = ""
+		if p, ok := cfg.Projects[r.project]; ok {
+			prefix = p.PackagePrefix
+		}
+	}
+	return runToJUnit(r, tests, packages, prefix), nil
+}
+
+// writeJUnit writes suites to w as an XML document.
+func writeJUnit(w io.Writer, suites *junitTestSuites) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func init() {
+	commands["export-junit"] = exportJUnitCommand
+}
+
+// exportJUnitCommand runs the "export-junit" subcommand, which writes a stored
+// run as JUnit XML.
+func exportJUnitCommand(args []string) {
+	fs := flag.NewFlagSet("export-junit", flag.ExitOnError)
+	dbInfoPtr := fs.String("dbinfo", "db-info.txt", "file in which db information is contained")
+	outPtr := fs.String("o", "", "file to write the XML to instead of stdout")
+	projectPtr := fs.String("project", "", "project whose runs branch refs refer to")
+	configPtr := fs.String("config", "", "JSON file containing the package prefix of each project")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export-junit [flags] <run>\n\nA run may be a run ID, a commit hash, run:<id>, commit:<hash> or branch:<name>.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := LoadConfig(*configPtr)
+	if err != nil {
+		log.Fatal("Error loading config: ", err)
+	}
+	env := openEnvironment(*dbInfoPtr, &Profile{Project: *projectPtr})
+	defer env.db.Close()
+
+	// The run is read before the output file is created, so that a bad ref
+	// doesn't leave an empty file behind.
+	suites, err := env.RunJUnit(fs.Arg(0), cfg)
+	if err != nil {
+		log.Fatal("Error exporting run: ", err)
+	}
+	w := io.Writer(os.Stdout)
+	if *outPtr != "" {
+		f, err := os.Create(*outPtr)
+		if err != nil {
+			log.Fatal("Error creating file for JUnit XML: ", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeJUnit(w, suites); err != nil {
+		log.Fatal("Error writing JUnit XML: ", err)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	gomail "gopkg.in/gomail.v2"
+
+	"github.com/marcinja/go-testdb/report"
+)
+
+// A Notifier sends a rendered update somewhere people will see it.
+type Notifier interface {
+	Notify(u *renderedReport) error
+}
+
+// NotifierConfig describes a notification channel in a profile. Type selects
+// which of the other fields are used:
+//
+//	smtp               Host, Port, TLS, Username, Password, From, To
+//	slack, mattermost  URL, Channel, Username
+//	webhook            URL, Headers
+//
+// Environment variables in Password, URL and Headers, written as $NAME or
+// ${NAME}, are expanded so that secrets can be kept out of config files.
+type NotifierConfig struct {
+	Type string `json:"type"`
+
+	Host     string   `json:"host,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	TLS      string   `json:"tls,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+
+	URL     string            `json:"url,omitempty"`
+	Channel string            `json:"channel,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// TLS modes for SMTP notifiers.
+const (
+	smtpStartTLS = "starttls"
+	smtpTLS      = "tls"
+	smtpNoTLS    = "none"
+)
+
+// notifyTimeout bounds how long a single notification may take.
+const notifyTimeout = 30 * time.Second
+
+// newNotifier builds the notifier described by cfg.
+func newNotifier(cfg *NotifierConfig) (Notifier, error) {
+	switch cfg.Type {
+	case "smtp":
+		n := &smtpNotifier{
+			host:     cfg.Host,
+			port:     cfg.Port,
+			tls:      cfg.TLS,
+			username: cfg.Username,
+			password: os.ExpandEnv(cfg.Password),
+			from:     cfg.From,
+			to:       cfg.To,
+		}
+		if n.tls == "" {
+			n.tls = smtpStartTLS
+		}
+		if n.port == 0 {
+			n.port = 587
+			if n.tls == smtpTLS {
+				n.port = 465
+			}
+		}
+		if n.from == "" {
+			n.from = n.username
+		}
+		switch {
+		case n.host == "":
+			return nil, fmt.Errorf("smtp notifier needs a host")
+		case n.from == "":
+			return nil, fmt.Errorf("smtp notifier needs a from address or username")
+		case len(n.to) == 0:
+			return nil, fmt.Errorf("smtp notifier needs at least one recipient")
+		case n.tls != smtpStartTLS && n.tls != smtpTLS && n.tls != smtpNoTLS:
+			return nil, fmt.Errorf("unknown smtp tls mode %q, expected starttls, tls or none", n.tls)
+		}
+		return n, nil
+
+	case "slack", "mattermost":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("%s notifier needs a url", cfg.Type)
+		}
+		return &chatNotifier{
+			url:      os.ExpandEnv(cfg.URL),
+			channel:  cfg.Channel,
+			username: cfg.Username,
+		}, nil
+
+	case "webhook":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("webhook notifier needs a url")
+		}
+		headers := make(map[string]string)
+		for k, v := range cfg.Headers {
+			headers[k] = os.ExpandEnv(v)
+		}
+		return &webhookNotifier{url: os.ExpandEnv(cfg.URL), headers: headers}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type %q, expected smtp, slack, mattermost or webhook", cfg.Type)
+}
+
+// smtpNotifier emails the update to a fixed list of recipients.
+type smtpNotifier struct {
+	host     string
+	port     int
+	tls      string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+// Notify sends the update as a multipart email with plain text and HTML
+// versions.
+func (n *smtpNotifier) Notify(u *renderedReport) error {
+	m := gomail.NewMessage()
+	m.SetHeader("From", n.from)
+	m.SetHeader("To", n.to...)
+	m.SetHeader("Subject", u.subject)
+	m.SetBody("text/plain", u.body)
+	if u.html != "" {
+		m.AddAlternative("text/html", u.html)
+	}
+	var msg bytes.Buffer
+	if _, err := m.WriteTo(&msg); err != nil {
+		return err
+	}
+
+	from, err := mail.ParseAddress(n.from)
+	if err != nil {
+		return fmt.Errorf("bad from address: %v", err)
+	}
+	var to []string
+	for _, addr := range n.to {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("bad recipient %q: %v", addr, err)
+		}
+		to = append(to, parsed.Address)
+	}
+
+	c, err := n.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if n.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.username, n.password, n.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// dial connects to the SMTP server using the notifier's TLS mode.
+func (n *smtpNotifier) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(n.host, strconv.Itoa(n.port))
+	tlsConfig := &tls.Config{ServerName: n.host}
+
+	var conn net.Conn
+	var err error
+	if n.tls == smtpTLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: notifyTimeout}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, notifyTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if n.tls == smtpStartTLS {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("starttls: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// chatMaxText is the longest message sent to a chat webhook. Slack truncates
+// longer messages anyway.
+const chatMaxText = 35000
+
+// chatNotifier posts the update to a Slack or Mattermost incoming webhook.
+type chatNotifier struct {
+	url      string
+	channel  string
+	username string
+}
+
+// Notify posts the subject in bold followed by the plain text body.
+func (n *chatNotifier) Notify(u *renderedReport) error {
+	body := u.body
+	if len(body) > chatMaxText {
+		body = truncateUTF8(body, chatMaxText) + "\n... (truncated)"
+	}
+	payload := struct {
+		Text     string `json:"text"`
+		Channel  string `json:"channel,omitempty"`
+		Username string `json:"username,omitempty"`
+	}{
+		Text:     "*" + u.subject + "*\n```\n" + strings.TrimRight(body, "\n") + "\n```",
+		Channel:  n.channel,
+		Username: n.username,
+	}
+	return postJSON(n.url, nil, payload)
+}
+
+// truncateUTF8 returns the longest prefix of s that is at most n bytes long
+// and doesn't end partway through a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// webhookNotifier posts the update, including the report it was rendered
+// from, as JSON.
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+}
+
+// Notify posts the subject, body and report.
+func (n *webhookNotifier) Notify(u *renderedReport) error {
+	payload := struct {
+		Subject string         `json:"subject"`
+		Body    string         `json:"body"`
+		Report  *report.Report `json:"report"`
+	}{u.subject, u.body, u.report}
+	return postJSON(n.url, n.headers, payload)
+}
+
+// postJSON posts v as JSON to url, failing on any status other than 2xx.
+func postJSON(url string, headers map[string]string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("posting to %v: %v: %s", req.URL.Host, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// notifyUpdate sends the update to every notifier of the environment's
+// profile, and a digest to each of its subscriptions that has something in
+// it, continuing past failures. It returns an error describing every
+// notifier that failed.
+func (env *Environment) notifyUpdate() error {
+	var notifiers []Notifier
+	for i, cfg := range env.profile.Notifiers {
+		n, err := newNotifier(cfg)
+		if err != nil {
+			return fmt.Errorf("notifier %d: %v", i, err)
+		}
+		notifiers = append(notifiers, n)
+	}
+	subscribers := make([][]Notifier, len(env.profile.Subscriptions))
+	for i, s := range env.profile.Subscriptions {
+		if err := s.validate(); err != nil {
+			return err
+		}
+		n, err := env.subscriptionNotifiers(s)
+		if err != nil {
+			return fmt.Errorf("subscription %q: %v", s.Name, err)
+		}
+		subscribers[i] = n
+	}
+
+	rt, err := loadReportTemplates(env.profile.TextTemplate, env.profile.HTMLTemplate)
+	if err != nil {
+		return fmt.Errorf("loading update templates: %v", err)
+	}
+	r, err := env.gatherReport()
+	if err != nil {
+		return fmt.Errorf("gathering update: %v", err)
+	}
+	// Subscriptions to other projects than the profile's get digests of a
+	// report on their project, gathered once for each project.
+	reports := map[string]*report.Report{env.profile.Project: r}
+
+	var failed []string
+	if len(notifiers) > 0 {
+		rendered, err := rt.render(r)
+		if err != nil {
+			return fmt.Errorf("rendering update: %v", err)
+		}
+		for i, n := range notifiers {
+			if err := n.Notify(rendered); err != nil {
+				failed = append(failed, fmt.Sprintf("notifier %d (%s): %v", i, env.profile.Notifiers[i].Type, err))
+			}
+		}
+	}
+	for i, s := range env.profile.Subscriptions {
+		project := env.profile.Project
+		if s.Project != "" {
+			project = s.Project
+		}
+		pr, ok := reports[project]
+		if !ok {
+			profile := *env.profile
+			profile.Project = project
+			pr, err = (&Environment{db: env.db, profile: &profile}).gatherReport()
+			if err != nil {
+				return fmt.Errorf("gathering update of project %q for %q: %v", project, s.Name, err)
+			}
+			reports[project] = pr
+		}
+		d := s.digest(pr)
+		if digestIsEmpty(d) {
+			continue
+		}
+		rendered, err := rt.render(d)
+		if err != nil {
+			return fmt.Errorf("rendering digest for %q: %v", s.Name, err)
+		}
+		for _, n := range subscribers[i] {
+			if err := n.Notify(rendered); err != nil {
+				failed = append(failed, fmt.Sprintf("subscription %q: %v", s.Name, err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/marcinja/go-testdb/report"
+)
+
+// testUpdate is the rendered update sent by the notifier tests.
+var testUpdate = &renderedReport{
+	subject: "Test update",
+	body:    "2 failures\n",
+	html:    "<p>2 failures</p>",
+	report:  &report.Report{Profile: "daily"},
+}
+
+func TestChatNotifier(t *testing.T) {
+	var payload struct {
+		Text     string `json:"text"`
+		Channel  string `json:"channel"`
+		Username string `json:"username"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	n, err := newNotifier(&NotifierConfig{Type: "slack", URL: srv.URL, Channel: "#tests", Username: "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(testUpdate); err != nil {
+		t.Fatal(err)
+	}
+	if want := "*Test update*\n```\n2 failures\n```"; payload.Text != want {
+		t.Errorf("text = %q, want %q", payload.Text, want)
+	}
+	if payload.Channel != "#tests" || payload.Username != "ci" {
+		t.Errorf("channel, username = %q, %q, want #tests, ci", payload.Channel, payload.Username)
+	}
+}
+
+func TestChatNotifierTruncatesOnRuneBoundary(t *testing.T) {
+	var text string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct{ Text string }
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+		text = payload.Text
+	}))
+	defer srv.Close()
+
+	// Every character after the first is two bytes, so the limit falls
+	// inside one.
+	u := *testUpdate
+	u.body = "a" + strings.Repeat("é", chatMaxText)
+	n := &chatNotifier{url: srv.URL}
+	if err := n.Notify(&u); err != nil {
+		t.Fatal(err)
+	}
+	// JSON encoding replaces a split character with U+FFFD.
+	if !utf8.ValidString(text) || strings.ContainsRune(text, utf8.RuneError) {
+		t.Error("truncated text ends partway through a character")
+	}
+	if !strings.Contains(text, "... (truncated)") {
+		t.Error("truncated text isn't marked as truncated")
+	}
+}
+
+func TestChatNotifierStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such channel", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	n := &chatNotifier{url: srv.URL}
+	err := n.Notify(testUpdate)
+	if err == nil || !strings.Contains(err.Error(), "no such channel") {
+		t.Errorf("error = %v, want one containing the response", err)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	t.Setenv("HOOK_TOKEN", "secret")
+	var auth string
+	var payload struct {
+		Subject string
+		Body    string
+		Report  *report.Report
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	n, err := newNotifier(&NotifierConfig{Type: "webhook", URL: srv.URL, Headers: map[string]string{"Authorization": "Bearer $HOOK_TOKEN"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(testUpdate); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("Authorization = %q, want the expanded header", auth)
+	}
+	if payload.Subject != testUpdate.subject || payload.Body != testUpdate.body {
+		t.Errorf("subject, body = %q, %q, want %q, %q", payload.Subject, payload.Body, testUpdate.subject, testUpdate.body)
+	}
+	if payload.Report == nil || payload.Report.Profile != "daily" {
+		t.Errorf("report = %+v, want the daily report", payload.Report)
+	}
+}
+
+// fakeSMTPServer accepts a single SMTP session on a local port, recording the
+// envelope and message it is sent.
+type fakeSMTPServer struct {
+	ln   net.Listener
+	done chan struct{}
+
+	from string
+	to   []string
+	data string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{ln: ln, done: make(chan struct{})}
+	go s.serve(t)
+	return s
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) serve(t *testing.T) {
+	defer close(s.done)
+	conn, err := s.ln.Accept()
+	if err != nil {
+		t.Errorf("accepting: %v", err)
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			s.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.to = append(s.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.data = data.String()
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Unknown command")
+		}
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	s := newFakeSMTPServer(t)
+	defer s.ln.Close()
+
+	n, err := newNotifier(&NotifierConfig{
+		Type: "smtp",
+		Host: "127.0.0.1",
+		Port: s.port(),
+		TLS:  smtpNoTLS,
+		From: "CI <ci@example.com>",
+		To:   []string{"dev@example.com", "Ops <ops@example.com>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(testUpdate); err != nil {
+		t.Fatal(err)
+	}
+	<-s.done
+
+	if s.from != "ci@example.com" {
+		t.Errorf("MAIL FROM = %q, want ci@example.com", s.from)
+	}
+	if strings.Join(s.to, ",") != "dev@example.com,ops@example.com" {
+		t.Errorf("RCPT TO = %q, want dev@example.com and ops@example.com", s.to)
+	}
+	for _, want := range []string{"Subject: Test update", "text/plain", "text/html", "2 failures"} {
+		if !strings.Contains(s.data, want) {
+			t.Errorf("message doesn't contain %q:\n%s", want, s.data)
+		}
+	}
+}
+
+func TestNewNotifierErrors(t *testing.T) {
+	for _, cfg := range []*NotifierConfig{
+		{Type: "smtp", From: "ci@example.com", To: []string{"dev@example.com"}},
+		{Type: "smtp", Host: "mail.example.com", To: []string{"dev@example.com"}},
+		{Type: "smtp", Host: "mail.example.com", From: "ci@example.com"},
+		{Type: "smtp", Host: "mail.example.com", From: "ci@example.com", To: []string{"dev@example.com"}, TLS: "ssl"},
+		{Type: "slack"},
+		{Type: "webhook"},
+		{Type: "pager"},
+	} {
+		if _, err := newNotifier(cfg); err == nil {
+			t.Errorf("newNotifier(%+v) succeeded, want an error", cfg)
+		}
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"héllo", 2, "h"},
+		{"héllo", 3, "hé"},
+		{"日本", 4, "日"},
+	} {
+		if got := truncateUTF8(c.s, c.n); got != c.want {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", c.s, c.n, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// table is a generic set of rows returned by a query, which can be written as
+// an aligned text table, CSV or JSON.
+type table struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+// formatCell converts a value in a table to the string used in text and CSV
+// output.
+func formatCell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.Format(referenceTime)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case Status:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// write writes the table in the given format: "table", "csv" or "json".
+func (t *table) write(w io.Writer, format string) error {
+	switch format {
+	case "table", "text":
+		return t.writeText(w)
+	case "csv":
+		return t.writeCSV(w)
+	case "json":
+		return t.writeJSON(w)
+	default:
+		return fmt.Errorf("unknown format %q, expected table, csv or json", format)
+	}
+}
+
+// writeText writes the table with its columns aligned.
+func (t *table) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, c := range t.columns {
+		if i > 0 {
+			fmt.Fprint(tw, "\t")
+		}
+		fmt.Fprint(tw, c)
+	}
+	fmt.Fprintln(tw)
+	for _, row := range t.rows {
+		for i, v := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, formatCell(v))
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// writeCSV writes the table as CSV with a header row.
+func (t *table) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(t.columns); err != nil {
+		return err
+	}
+	for _, row := range t.rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = formatCell(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSON writes the table as an array of objects keyed by column name.
+func (t *table) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(t.objects())
+}
+
+// objects returns the rows of the table as objects keyed by column name.
+func (t *table) objects() []map[string]interface{} {
+	objects := make([]map[string]interface{}, 0, len(t.rows))
+	for _, row := range t.rows {
+		obj := make(map[string]interface{}, len(row))
+		for i, v := range row {
+			if s, ok := v.(Status); ok {
+				obj[t.columns[i]] = s.String()
+				continue
+			}
+			obj[t.columns[i]] = v
+		}
+		objects = append(objects, obj)
+	}
+	return objects
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/marcinja/go-testdb/report"
+)
+
+// codeOwnersLocations are where GitHub looks for a CODEOWNERS file in a
+// checkout, in order.
+var codeOwnersLocations = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+// ownerRule assigns owners to the paths matched by a pattern.
+type ownerRule struct {
+	pattern string
+	owners  []string
+}
+
+// ownerRules are the rules of a CODEOWNERS file. As in GitHub, the last rule
+// matching a path decides its owners.
+type ownerRules []ownerRule
+
+// loadOwners reads owner rules from a CODEOWNERS file, or from the CODEOWNERS
+// file of the checkout at the given directory.
+func loadOwners(p string) (ownerRules, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		dir := p
+		p = ""
+		for _, loc := range codeOwnersLocations {
+			if _, err := os.Stat(filepath.Join(dir, loc)); err == nil {
+				p = filepath.Join(dir, loc)
+				break
+			}
+		}
+		if p == "" {
+			return nil, fmt.Errorf("no CODEOWNERS file in %v", dir)
+		}
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseOwners(f)
+}
+
+// parseOwners parses rules in the CODEOWNERS format: a path pattern followed
+// by its owners on each line, with # starting a comment. A simple mapping of
+// directories to owners is written the same way, e.g. "modules/renter alice".
+func parseOwners(r io.Reader) (ownerRules, error) {
+	var rules ownerRules
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		// A pattern without owners removes the ownership given by earlier
+		// rules.
+		rule := ownerRule{pattern: fields[0], owners: fields[1:]}
+		if _, err := path.Match(strings.Trim(rule.pattern, "/"), ""); err != nil {
+			return nil, fmt.Errorf("line %d: bad pattern %q", line, rule.pattern)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, s.Err()
+}
+
+// packageOwners returns the owners of the package in the given directory,
+// relative to the root of the checkout. A package is owned by whoever owns
+// its test files, so patterns naming the directory, a parent of it, or files
+// such as "*.go" all apply.
+func (rules ownerRules) packageOwners(dir string) []string {
+	file := path.Join(dir, "package_test.go")
+	for i := len(rules) - 1; i >= 0; i-- {
+		if matchOwnerPattern(rules[i].pattern, file) {
+			return rules[i].owners
+		}
+	}
+	return nil
+}
+
+// matchOwnerPattern reports whether a CODEOWNERS pattern matches the given
+// file. Patterns follow the gitignore rules that CODEOWNERS uses: a pattern
+// containing a slash other than a trailing one is anchored at the root, other
+// patterns match at any depth, a trailing slash matches only directories, and
+// a directory pattern matches everything below it.
+func matchOwnerPattern(pattern, file string) bool {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	anchored := !strings.HasPrefix(pattern, "**/") && strings.Contains(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/**")
+	pattern = strings.TrimPrefix(strings.TrimPrefix(pattern, "**/"), "/")
+	if pattern == "" || pattern == "*" || pattern == "**" {
+		return true
+	}
+
+	// The pattern may match the file itself or any directory above it,
+	// starting at the root if it is anchored and anywhere otherwise.
+	segs := strings.Split(file, "/")
+	patSegs := strings.Split(pattern, "/")
+	last := len(segs) - len(patSegs)
+	if anchored && last > 0 {
+		last = 0
+	}
+	for start := 0; start <= last; start++ {
+		end := start + len(patSegs)
+		if dirOnly && end == len(segs) {
+			continue
+		}
+		if matchSegments(patSegs, segs[start:end]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches path segments against pattern segments one by one.
+func matchSegments(patSegs, segs []string) bool {
+	for i, p := range patSegs {
+		if ok, _ := path.Match(p, segs[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// insertRunOwners records the owners of each package in a run.
+func (env *Environment) insertRunOwners(runID int64, results *Result, rules ownerRules) error {
+	stmt, err := env.db.Prepare("INSERT runOwners SET runID=?,packageName=?,owner=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	seen := make(map[string]bool)
+	var pkgs []string
+	for _, p := range results.packageResults {
+		pkgs = append(pkgs, p.name)
+	}
+	for _, t := range results.testResults {
+		pkgs = append(pkgs, t.pkg)
+	}
+	for _, pkg := range pkgs {
+		if pkg == "" || seen[pkg] {
+			continue
+		}
+		seen[pkg] = true
+		for _, owner := range rules.packageOwners(pkg) {
+			if _, err := stmt.Exec(runID, pkg, owner); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ownersFromWindow returns the owners recorded for each package of each run
+// within the profile's window, keyed by run ID and then package.
+func (env *Environment) ownersFromWindow() (map[int64]map[string][]string, error) {
+	rows, err := env.db.Query("select o.runID, o.packageName, o.owner from runOwners o join runs r on r.id = o.runID where r.dateTime between date_sub(now(), INTERVAL ? SECOND) and now() and "+runScopeFilter+" order by o.owner;", append([]interface{}{env.profile.Window.Seconds()}, env.scopeArgs()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := make(map[int64]map[string][]string)
+	for rows.Next() {
+		var (
+			runID      int64
+			pkg, owner string
+		)
+		if err := rows.Scan(&runID, &pkg, &owner); err != nil {
+			return nil, err
+		}
+		if owners[runID] == nil {
+			owners[runID] = make(map[string][]string)
+		}
+		owners[runID][pkg] = append(owners[runID][pkg], owner)
+	}
+	return owners, rows.Err()
+}
+
+// groupFailuresByOwner groups failures under each of their owners, with
+// failures that have no owner in a group with an empty Owner at the end. It
+// returns nil if no failure has an owner.
+func groupFailuresByOwner(failures []*report.Failure) []*report.OwnerFailures {
+	groups := make(map[string]*report.OwnerFailures)
+	var unowned []*report.Failure
+	for _, f := range failures {
+		if len(f.Owners) == 0 {
+			unowned = append(unowned, f)
+			continue
+		}
+		for _, owner := range f.Owners {
+			g, ok := groups[owner]
+			if !ok {
+				g = &report.OwnerFailures{Owner: owner}
+				groups[owner] = g
+			}
+			g.Failures = append(g.Failures, f)
+		}
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	var byOwner []*report.OwnerFailures
+	for _, g := range groups {
+		byOwner = append(byOwner, g)
+	}
+	sort.Slice(byOwner, func(i, j int) bool {
+		return byOwner[i].Owner < byOwner[j].Owner
+	})
+	if len(unowned) > 0 {
+		byOwner = append(byOwner, &report.OwnerFailures{Failures: unowned})
+	}
+	return byOwner
+}
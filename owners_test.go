@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchOwnerPattern(t *testing.T) {
+	for _, c := range []struct {
+		pattern, file string
+		want          bool
+	}{
+		{"*", "modules/renter/package_test.go", true},
+		{"**", "modules/renter/package_test.go", true},
+		{"*.go", "modules/renter/package_test.go", true},
+		{"*.js", "modules/renter/package_test.go", false},
+
+		// Patterns without a slash match at any depth.
+		{"renter", "modules/renter/package_test.go", true},
+		{"renter/", "modules/renter/package_test.go", true},
+		{"renter/", "modules/renter", false},
+		{"proxy", "modules/renter/package_test.go", false},
+
+		// Patterns with a slash are anchored at the root.
+		{"/modules/renter/", "modules/renter/package_test.go", true},
+		{"/modules/renter/", "modules/renter/proxy/package_test.go", true},
+		{"modules/renter", "modules/renter/package_test.go", true},
+		{"/renter/", "modules/renter/package_test.go", false},
+		{"renter/proxy", "modules/renter/proxy/package_test.go", false},
+		{"/modules/renter/", "modules/renterhost/package_test.go", false},
+		{"/modules/*/", "modules/host/package_test.go", true},
+		{"/modules/renter/*.go", "modules/renter/package_test.go", true},
+
+		// A leading "**/" matches at any depth, and a trailing "/**"
+		// everything below.
+		{"**/proxy", "modules/renter/proxy/package_test.go", true},
+		{"**/renter/proxy", "modules/renter/proxy/package_test.go", true},
+		{"modules/**", "modules/renter/package_test.go", true},
+		{"node/**", "modules/renter/package_test.go", false},
+	} {
+		if got := matchOwnerPattern(c.pattern, c.file); got != c.want {
+			t.Errorf("matchOwnerPattern(%q, %q) = %v, want %v", c.pattern, c.file, got, c.want)
+		}
+	}
+}
+
+func TestPackageOwners(t *testing.T) {
+	rules, err := parseOwners(strings.NewReader(`
+# Default owners
+*                  @core
+/modules/renter/   @renter-team alice
+/modules/renter/proxy
+modules/host       bob # the host
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		dir  string
+		want []string
+	}{
+		{"node", []string{"@core"}},
+		{"modules/renter", []string{"@renter-team", "alice"}},
+		{"modules/renter/contractor", []string{"@renter-team", "alice"}},
+		{"modules/renter/proxy", []string{}},
+		{"modules/host", []string{"bob"}},
+	} {
+		if got := rules.packageOwners(c.dir); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("packageOwners(%q) = %v, want %v", c.dir, got, c.want)
+		}
+	}
+
+	if _, err := parseOwners(strings.NewReader("[ alice")); err == nil {
+		t.Error("parsing a bad pattern succeeded, want an error")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -21,18 +22,43 @@ const (
 	failedTest string = "--- FAIL:"
 	passedTest string = "--- PASS:"
 
-	// Lines giving package results.
-	packageFail   string = "FAIL	github.com/"
-	packagePass   string = "ok  	github.com/"
-	packagePrefix string = "github.com/NebulousLabs/Sia/"
-
 	//Reference time formatting for dateTimes.
 	referenceTime string = "2006-01-02-15:04:05"
 
 	// panicTest checks for when a test has resulted in a panic
 	panicTest string = "panic: "
+
+	// panicTestName is the name under which panics are stored in the tests
+	// table.
+	panicTestName string = "PANIC"
 )
 
+// packageResultLine matches the line `go test` prints when a package is done:
+// "ok", "FAIL" or "?" (no test files), the package and the rest of the line,
+// which starts with its duration, "(cached)" or a reason it failed.
+var packageResultLine = regexp.MustCompile(`^(ok  |FAIL|\?   )\t(\S+)(.*)$`)
+
+// parsePackageResult parses a package result line. ok reports whether the line
+// is one, and the result is nil for packages without test files. Packages
+// that were cached or failed to build are given no duration.
+func parsePackageResult(line string) (r *PackageResult, ok bool) {
+	m := packageResultLine.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+	if m[1] == "?   " {
+		return nil, true
+	}
+	r = &PackageResult{name: m[2], result: Status(PASSED)}
+	if m[1] == "FAIL" {
+		r.result = FAILED
+	}
+	if fields := strings.Fields(m[3]); len(fields) > 0 {
+		r.duration, _ = time.ParseDuration(fields[0])
+	}
+	return r, true
+}
+
 // ReadFile reads the file with the given name and returns a slice of string,
 // one for each line of the file.
 func ReadFile(name string) []string {
@@ -57,69 +83,112 @@ func ReadFile(name string) []string {
 }
 
 // ParseErrorLog parses the given file and creates a result object using the
-// information contained in the file.
-func ParseErrorLog(name string) *Result {
-	lines := ReadFile(name)
-
+// information contained in the file. The date time of the run is taken from
+// the file name, which must be of the form error-2006-01-02-15:04:05.log.
+func ParseErrorLog(name string) (*Result, error) {
 	dateTimeStr := strings.TrimPrefix(strings.TrimSuffix(filepath.Base(name), ".log"), "error-")
 	dateTime, err := time.Parse(referenceTime, dateTimeStr)
 	if err != nil {
-		fmt.Println(err)
+		return nil, fmt.Errorf("no date time in file name: %v", err)
+	}
+	return parseTextLogFile(name, dateTime)
+}
+
+// parseTextLogFile parses the text log in the given file as a run at the
+// given date time.
+func parseTextLogFile(name string, dateTime time.Time) (*Result, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
 	}
+	return parseLogLines(lines, dateTime)
+}
 
+// parseLogLines parses the lines of a test log and creates a result object
+// with the given date time using the information contained in the lines. It
+// returns an error for test result lines without a duration, and a commit
+// hash line with no hash after it.
+func parseLogLines(lines []string, dateTime time.Time) (*Result, error) {
 	// The other Result fields:
 	var commitHash string
 	var testResults []*TestResult
 	var packageResults []*PackageResult
 
-	testsStarted := make(map[string]struct{})
+	// Tests are printed before the result line of their package, so results
+	// are assigned a package when its result line is reached. testsStarted
+	// maps each started test to its package, once known.
+	testsStarted := make(map[string]string)
+	firstUnassigned := 0
+	assignPackage := func(packageName string) {
+		for _, r := range testResults[firstUnassigned:] {
+			r.pkg = packageName
+		}
+		firstUnassigned = len(testResults)
+		for t, pkg := range testsStarted {
+			if pkg == "" {
+				testsStarted[t] = packageName
+			}
+		}
+	}
+
+	// testOutput returns the result line at i followed by the indented
+	// output lines after it, and the index of the last output line.
+	testOutput := func(i int, prefix string) ([]string, int) {
+		out := strings.Split(strings.TrimSpace(strings.TrimPrefix(lines[i], prefix)), " ")
+		j := i + 1
+		for j < len(lines) && strings.HasPrefix(lines[j], "\t") {
+			out = append(out, lines[j])
+			j++
+		}
+		return out, j - 1
+	}
+
 	for i := 0; i < len(lines); i++ {
 		switch {
 		case strings.HasPrefix(lines[i], commitHashLine):
 			// Store the commit hash of the code run by this test.
+			if i+1 >= len(lines) {
+				return nil, fmt.Errorf("line %d: no commit hash after %q", i+1, commitHashLine)
+			}
 			commitHash = strings.TrimSpace(lines[i+1])
 			i++ //Skip the line with the hash we just stored.
 
 		case strings.HasPrefix(lines[i], runTest):
 			// Store the name of this test.
 			testName := strings.TrimSpace(strings.TrimPrefix(lines[i], runTest))
-			testsStarted[testName] = struct{}{}
+			testsStarted[testName] = ""
 
 		case strings.HasPrefix(lines[i], skipTest):
-			skippedTest := strings.Split(strings.TrimSpace(strings.TrimPrefix(lines[i], skipTest)), " ")
-
-			// Add all lines that contain information about this test.
-			for j := 1; j < len(lines); j++ {
-				nextLine := lines[i+j]
-				if strings.HasPrefix(nextLine, "\t") {
-					skippedTest = append(skippedTest, nextLine)
-				} else {
-					i += j // Account for the lines appended.
-					break
-				}
+			skippedTest, last := testOutput(i, skipTest)
+			r, err := handleSkippedTest(skippedTest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
 			}
+			i = last // Account for the lines appended.
 
-			r := handleSkippedTest(skippedTest)
 			// Add the result to the slice of results and remove the test name
 			// from the set so that it doesn't get handled twice.
 			testResults = append(testResults, r)
 			delete(testsStarted, r.name)
 
 		case strings.HasPrefix(lines[i], failedTest):
-			fail := strings.Split(strings.TrimSpace(strings.TrimPrefix(lines[i], failedTest)), " ")
-
-			// Add all lines that contain information about this test.
-			for j := 1; j < len(lines); j++ {
-				nextLine := lines[i+j]
-				if strings.HasPrefix(nextLine, "\t") {
-					fail = append(fail, nextLine)
-				} else {
-					i += j // Account for the lines appended.
-					break
-				}
+			fail, last := testOutput(i, failedTest)
+			r, err := handleFailedTest(fail)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
 			}
+			i = last // Account for the lines appended.
 
-			r := handleFailedTest(fail)
 			// Add the result to the slice of results and remove the test name
 			// from the set so that it doesn't get handled twice.
 			testResults = append(testResults, r)
@@ -127,10 +196,9 @@ func ParseErrorLog(name string) *Result {
 
 		case strings.HasPrefix(lines[i], passedTest):
 			pass := strings.Split(strings.TrimSpace(strings.TrimPrefix(lines[i], passedTest)), " ")
-			durStr := strings.TrimPrefix(strings.TrimSuffix(pass[1], ")"), "(") // Remove surrounding parentheses.
-			dur, err := time.ParseDuration(durStr)
+			dur, err := parseTestDuration(pass)
 			if err != nil {
-				fmt.Println(err)
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
 			}
 			r := &TestResult{
 				name:     pass[0],
@@ -149,51 +217,28 @@ func ParseErrorLog(name string) *Result {
 			// This lets us search for panics easily without changing the db
 			// setup.
 			pr := &TestResult{
-				name:     "PANIC",
+				name:     panicTestName,
 				result:   Status(FAILED),
 				duration: 0,
 			}
 
 			testResults = append(testResults, pr)
 
-		case strings.HasPrefix(lines[i], packageFail):
-			fail := strings.Split(strings.TrimSpace(strings.TrimPrefix(lines[i], "FAIL")), "\t")
-			packageName := strings.TrimPrefix(fail[0], packagePrefix)
-			packageDur, err := time.ParseDuration(fail[1])
-			if err != nil {
-				fmt.Println(err)
-			}
-
-			mr := &PackageResult{
-				name:     packageName,
-				result:   Status(FAILED),
-				duration: packageDur,
-			}
-			packageResults = append(packageResults, mr)
-
-		case strings.HasPrefix(lines[i], packagePass):
-			pass := strings.Split(strings.TrimSpace(strings.TrimPrefix(lines[i], "ok")), "\t")
-			packageName := strings.TrimPrefix(pass[0], packagePrefix)
-			packageDur, err := time.ParseDuration(pass[1])
-			if err != nil {
-				fmt.Println(err)
-			}
-
-			mr := &PackageResult{
-				name:     packageName,
-				result:   Status(PASSED),
-				duration: packageDur,
-			}
-			packageResults = append(packageResults, mr)
-
 		default:
+			// Package names are left whole; the run's package prefix is
+			// trimmed from them when it is stored.
+			if r, ok := parsePackageResult(lines[i]); ok && r != nil {
+				packageResults = append(packageResults, r)
+				assignPackage(r.name)
+			}
 		}
 	}
 
 	// Add all tests that were started and not heard back from as 'UNDETERMINED' tests.
-	for t := range testsStarted {
+	for t, pkg := range testsStarted {
 		r := &TestResult{
 			name:     t,
+			pkg:      pkg,
 			result:   Status(UNDETERMINED),
 			output:   "",
 			duration: 0,
@@ -206,20 +251,32 @@ func ParseErrorLog(name string) *Result {
 		dateTime:       dateTime,
 		testResults:    testResults,
 		packageResults: packageResults,
+	}, nil
+}
+
+// parseTestDuration parses the duration of a test from its result line split
+// on spaces: the test's name followed by its duration in the form "(0.00s)".
+func parseTestDuration(fields []string) (time.Duration, error) {
+	if len(fields) < 2 || fields[0] == "" {
+		return 0, fmt.Errorf("test result without a name and duration")
 	}
+	durStr := strings.TrimPrefix(strings.TrimSuffix(fields[1], ")"), "(") // Remove surrounding parentheses.
+	dur, err := time.ParseDuration(durStr)
+	if err != nil {
+		return 0, fmt.Errorf("bad duration of %v: %v", fields[0], err)
+	}
+	return dur, nil
 }
 
 // handleSkippedTest creates a testResult object from a slice of strings in
 // which the first element is the name of the test, the second element is the
 // duration of the test in the form "(0.00s)", and the third(last) element is
-// the output of the test.
-func handleSkippedTest(testOutput []string) *TestResult {
+// the output of the test. It returns an error if the duration is missing.
+func handleSkippedTest(testOutput []string) (*TestResult, error) {
 	// Get the duration of the test.
-	durStr := testOutput[1]
-	durStr = strings.TrimPrefix(strings.TrimSuffix(durStr, ")"), "(") // Remove surrounding parentheses.
-	dur, err := time.ParseDuration(durStr)
+	dur, err := parseTestDuration(testOutput)
 	if err != nil {
-		fmt.Println("Errord: parsing skipped test duration: ", err)
+		return nil, err
 	}
 
 	// A skipped test can have 0 or more lines of output.
@@ -241,20 +298,18 @@ func handleSkippedTest(testOutput []string) *TestResult {
 		duration: dur,
 	}
 
-	return r
+	return r, nil
 }
 
 // handleFailedTest creates a testResult object from a slice of strings in
 // which the first element is the name of the test, the second element is the
 // duration of the test in the form "(0.00s)", and the third(last) element is
-// the output of the test.
-func handleFailedTest(testOutput []string) *TestResult {
+// the output of the test. It returns an error if the duration is missing.
+func handleFailedTest(testOutput []string) (*TestResult, error) {
 	// Get the duration of the test.
-	durStr := testOutput[1]
-	durStr = strings.TrimPrefix(strings.TrimSuffix(durStr, ")"), "(") // Remove surrounding parentheses.
-	dur, err := time.ParseDuration(durStr)
+	dur, err := parseTestDuration(testOutput)
 	if err != nil {
-		fmt.Println("Errord: parsing failed test duration: ", err)
+		return nil, err
 	}
 
 	// A failed test can have 0 or more lines of output.
@@ -276,5 +331,5 @@ func handleFailedTest(testOutput []string) *TestResult {
 		duration: dur,
 	}
 
-	return r
+	return r, nil
 }
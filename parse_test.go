@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLines(t *testing.T) {
+	lines := strings.Split(`At commit:
+abc123
+=== RUN   TestPass
+--- PASS: TestPass (1.50s)
+=== RUN   TestFail
+--- FAIL: TestFail (0.25s)
+	foo_test.go:10: broken
+=== RUN   TestSkip
+--- SKIP: TestSkip (0.00s)
+	foo_test.go:20: not today
+=== RUN   TestHang
+FAIL
+FAIL	gitlab.com/acme/hostdb/modules	1.750s
+ok  	gitlab.com/acme/hostdb/types	(cached)
+?   	gitlab.com/acme/hostdb/cmd	[no test files]
+FAIL	gitlab.com/acme/hostdb/api [build failed]`, "\n")
+	r, err := parseLogLines(lines, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyRunMetadata(r, &runMetadata{packagePrefix: "gitlab.com/acme/hostdb/"})
+	if r.commitHash != "abc123" {
+		t.Errorf("commit hash = %q, want abc123", r.commitHash)
+	}
+	want := map[string]Status{"TestPass": PASSED, "TestFail": FAILED, "TestSkip": SKIPPED, "TestHang": UNDETERMINED}
+	if len(r.testResults) != len(want) {
+		t.Fatalf("got %d test results, want %d", len(r.testResults), len(want))
+	}
+	for _, tr := range r.testResults {
+		if tr.result != want[tr.name] {
+			t.Errorf("%v = %v, want %v", tr.name, tr.result, want[tr.name])
+		}
+		if tr.pkg != "modules" {
+			t.Errorf("%v is in package %q, want modules", tr.name, tr.pkg)
+		}
+	}
+	wantPackages := []PackageResult{
+		{name: "modules", result: FAILED, duration: 1750 * time.Millisecond},
+		{name: "types", result: PASSED},
+		{name: "api", result: FAILED},
+	}
+	if len(r.packageResults) != len(wantPackages) {
+		t.Fatalf("got %d package results, want %d", len(r.packageResults), len(wantPackages))
+	}
+	for i, p := range r.packageResults {
+		if *p != wantPackages[i] {
+			t.Errorf("package result %d = %+v, want %+v", i, *p, wantPackages[i])
+		}
+	}
+}
+
+func TestParseLogLinesMalformed(t *testing.T) {
+	for _, log := range []string{
+		"--- PASS: TestX",
+		"--- FAIL: TestX",
+		"--- SKIP: TestX",
+		"--- PASS: TestX (soon)",
+		"--- PASS:",
+		"At commit:",
+	} {
+		if _, err := parseLogLines(strings.Split(log, "\n"), time.Time{}); err == nil {
+			t.Errorf("parsing %q succeeded, want an error", log)
+		}
+	}
+}
+
+func TestParseLogLinesOutputAtEnd(t *testing.T) {
+	// A failure's output may end the log.
+	r, err := parseLogLines([]string{"--- FAIL: TestX (0.01s)", "\toops"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.testResults) != 1 || r.testResults[0].output != "\toops" {
+		t.Errorf("test results = %+v, want TestX with its output", r.testResults)
+	}
+}
@@ -2,176 +2,131 @@ package main
 
 import (
 	"database/sql"
-	"log"
 	"math"
+	"sort"
 )
 
-const (
-	avgFromCommitHash string = "select AVG(duration) from tests where datetime between date_sub(now(), INTERVAL 1 WEEK) and now() and name = ? and commitHash = ? and result='PASSED';"
-	avgFromLastWeek   string = "select AVG(duration) from tests where datetime between date_sub(now(), INTERVAL 1 WEEK) and now() and name = ? and result='PASSED' and commitHash != ?;"
-)
+// passingDurationSum is the number and total duration, in seconds, of a
+// test's passing results.
+type passingDurationSum struct {
+	runs  int64
+	total float64
+}
+
+// mean returns the mean duration, or false if there are no results.
+func (s passingDurationSum) mean() (float64, bool) {
+	if s.runs <= 0 {
+		return 0, false
+	}
+	return s.total / float64(s.runs), true
+}
 
 type performanceDiff struct {
-	name              string
+	testID
 	performanceChange float64
 }
 
-// averageDuration gives the average duraction of the given slice of test
-// results.
-func averageDuration(results []*TestResult) float64 {
-	// This function is reaaaally slow. It's much better to ask MySql to do the
-	// averaging for you!
-	var totalSum float64
-	for _, tr := range results {
-		totalSum += tr.duration.Seconds()
-	}
-
-	if len(results) == 0 {
-		return 0
-	} else {
-		avg := totalSum / float64(len(results))
-		if avg < 0.1 {
-			return 0
-		} else {
-			return avg
-		}
+// baselineDurationSums returns the passing durations of each test on the days
+// of the baseline window, in the profile's project and the given branch, from
+// the daily duration summaries. As with branchFilter, an empty branch means
+// every run that isn't of a pull request.
+func (e *Environment) baselineDurationSums(branch string) (map[testID]passingDurationSum, error) {
+	project := e.profile.Project
+	rows, err := e.db.Query("select packageName, name, sum(runs), sum(runs*mean) from durationAggregates where kind='test' and day >= date(date_sub(now(), INTERVAL ? SECOND)) and (? = '' or project = ?) and if(? = '', not pullRequest, branch = ?) group by packageName, name;", e.profile.Baseline.Seconds(), project, project, branch, branch)
+	if err != nil {
+		return nil, err
 	}
+	return scanDurationSums(rows)
 }
 
-// averageDurationFromCommitHash returns the average duration for a given test
-// at a specific commit hash. Returns true if the result from MySql is not NULL.
-func averageDurationFromCommitHash(stmt *sql.Stmt, testName string, latestCommit string) (float64, bool) {
-	var avg sql.NullFloat64
-
-	rows, err := stmt.Query(testName, latestCommit)
+// commitDurationSums returns the passing durations of each test at the given
+// commit on the days of the baseline window, in the scope given by scopeArgs.
+func (e *Environment) commitDurationSums(hash string, scope []interface{}) (map[testID]passingDurationSum, error) {
+	rows, err := e.db.Query("select coalesce(packageName, ''), name, count(*), sum(duration) from tests where dateTime >= date(date_sub(now(), INTERVAL ? SECOND)) and commitHash = ? and result='PASSED' and name != ? and "+scopeFilter+" group by packageName, name;", append([]interface{}{e.profile.Baseline.Seconds(), hash, panicTestName}, scope...)...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return scanDurationSums(rows)
+}
+
+// scanDurationSums reads the package, name, number of results and total
+// duration of each test from rows, closing them.
+func scanDurationSums(rows *sql.Rows) (map[testID]passingDurationSum, error) {
 	defer rows.Close()
-	if rows.Next() {
-		err := rows.Scan(&avg)
-		if err != nil {
-			panic(err)
+	sums := make(map[testID]passingDurationSum)
+	for rows.Next() {
+		var t testID
+		var s passingDurationSum
+		if err := rows.Scan(&t.pkg, &t.name, &s.runs, &s.total); err != nil {
+			return nil, err
 		}
+		sums[t] = s
 	}
-	err = rows.Err()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if avg.Valid {
-		return avg.Float64, true
-	} else {
-		return 0, false
-	}
-
+	return sums, rows.Err()
 }
 
-// averageDurationFromLastWeek returns the average duration for a given test for
-// the last week, ignoring results from the most recent commit. Returns true if
-// the result from MySql is not NULL.
-func averageDurationFromLastWeek(stmt *sql.Stmt, testName string, hash string) (float64, bool) {
-	var avg sql.NullFloat64
-	rows, err := stmt.Query(testName, hash)
-	if err != nil {
-		log.Fatal(err)
+// performanceDiffsFromBaseline returns a slice of performance diffs which
+// summarize performance changes for tests longer than the profile's minimum
+// duration and which saw a change in performance over the baseline window
+// compared to the most recent commit greater than the profile's thresholds.
+// The baseline is taken from the branch the most recent run targets, so that
+// a feature branch is compared against the branch it will be merged into. It
+// is read from the daily duration summaries, less the results of the most
+// recent commit, so the window is rounded back to the start of its first day.
+func (e *Environment) performanceDiffsFromBaseline() ([]*performanceDiff, error) {
+	p := e.profile
+	latestCommit, baselineBranch, err := e.mostRecentCommitHash()
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
-	defer rows.Close()
-	if rows.Next() {
-		err := rows.Scan(&avg)
-		if err != nil {
-			panic(err)
-		}
-	}
-	err = rows.Err()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	if avg.Valid {
-		return avg.Float64, true
-	} else {
-		return 0, false
+	baseline, err := e.baselineDurationSums(baselineBranch)
+	if err != nil {
+		return nil, err
 	}
-}
-
-// performanceDiffsFromLastWeek returns a slice of performance diffs which
-// summarize performance changes for tests greater than 5 seconds in length and
-// which saw a 20% or greater change in performance over the last week compared
-// to the most recent commit.
-func (e *Environment) performanceDiffsFromLastWeek() []*performanceDiff {
-	latestCommit := e.mostRecentCommitHash()
-	testNames := e.testNamesFromLastWeek()
-
-	avgFromLastWeekStmt, err := e.db.Prepare(avgFromLastWeek)
+	recent, err := e.commitDurationSums(latestCommit, e.scopeArgs())
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer avgFromLastWeekStmt.Close()
-
-	avgFromCommitHashStmt, err := e.db.Prepare(avgFromCommitHash)
+	// The most recent commit's results on the baseline branch are part of
+	// the summaries, and are taken back out.
+	recentInBaseline, err := e.commitDurationSums(latestCommit, []interface{}{p.Project, p.Project, baselineBranch, baselineBranch})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer avgFromCommitHashStmt.Close()
 
 	var diffs []*performanceDiff
-	for _, name := range testNames {
-		avgFromResults, ok := averageDurationFromLastWeek(avgFromLastWeekStmt, name, latestCommit)
+	for t, r := range recent {
+		avgFromRecentResults, ok := r.mean()
 		if !ok {
 			continue
 		}
-		avgFromRecentResults, ok := averageDurationFromCommitHash(avgFromCommitHashStmt, name, latestCommit)
+		b := baseline[t]
+		b.runs -= recentInBaseline[t].runs
+		b.total -= recentInBaseline[t].total
+		avgFromResults, ok := b.mean()
 		if !ok {
 			continue
 		}
 
 		// Short tests are ignored.
-		if avgFromResults < 5.0 && avgFromRecentResults < 5.0 {
+		if avgFromResults < p.PerfMinDuration && avgFromRecentResults < p.PerfMinDuration {
 			continue
 		}
 
 		performanceDifference := avgFromRecentResults - avgFromResults
-		//Add to diff if there is more than a 20% difference in performance.
-		if math.Abs(performanceDifference) >= avgFromResults*0.2 && math.Abs(performanceDifference) >= 2.5 {
-			println("\nDIFF: ", performanceDifference)
-			println(name)
+		// Add to diff if the difference in performance exceeds both thresholds.
+		if math.Abs(performanceDifference) >= avgFromResults*p.PerfChangeRatio && math.Abs(performanceDifference) >= p.PerfMinDelta {
 			diff := &performanceDiff{
-				name:              name,
+				testID:            t,
 				performanceChange: performanceDifference,
 			}
 			diffs = append(diffs, diff)
 		}
 	}
-	return diffs
-}
-
-// testNamesFromLastWeek returns a slice containing the names of every
-// individual test that was run in the last week.
-func (env *Environment) testNamesFromLastWeek() []string {
-	const nameQuery string = "select name from tests where datetime between date_sub(now(), INTERVAL 1 WEEK) and now() group by name;"
-
-	var results []string
-	// Make query to db.
-	rows, err := env.db.Query(nameQuery)
-	if err != nil {
-		panic(err)
-	}
-
-	// Collect results of query.
-	defer rows.Close()
-	for rows.Next() {
-		var name string
-		err := rows.Scan(&name)
-		if err != nil {
-			log.Fatal(err)
-		}
-		results = append(results, name)
-	}
-	err = rows.Err()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return results
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].less(diffs[j].testID) })
+	return diffs, nil
 }
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// outputSnippetLength is the number of characters of a test's output shown in
+// its history.
+const outputSnippetLength = 80
+
+// queryFilter narrows the rows considered by a query. Zero values leave the
+// corresponding restriction out.
+type queryFilter struct {
+	window Window
+	pkg    string
+	status string
+	label  string
+	branch string
+	since  *run
+	until  *run
+	run    *run
+
+	// projects, when set, limits results to runs of the given projects.
+	projects []string
+
+	// topo orders runs and history by the topology of their commits, as
+	// read from a checkout, rather than by date time. Runs whose commits
+	// weren't read come last.
+	topo bool
+
+	// limit, when set, selects a page of at most limit rows of a listing,
+	// after skipping the first offset.
+	limit, offset int
+}
+
+// orderBy returns an SQL order by clause sorting rows of the table with the
+// given alias, whose commit metadata is joined as c, oldest first, or newest
+// first if desc is set.
+func (f *queryFilter) orderBy(alias string, desc bool) string {
+	dir := ""
+	if desc {
+		dir = " desc"
+	}
+	if f.topo {
+		return " order by c.generation is null, c.generation" + dir + ", " + alias + ".dateTime" + dir
+	}
+	return " order by " + alias + ".dateTime" + dir
+}
+
+// page returns an SQL limit clause, beginning with a space, and its arguments,
+// selecting the filter's page of a listing. It is empty without a limit.
+func (f *queryFilter) page() (string, []interface{}) {
+	if f.limit == 0 {
+		return "", nil
+	}
+	return " limit ? offset ?", []interface{}{f.limit, f.offset}
+}
+
+// where returns an SQL condition, beginning with " and", and its arguments,
+// restricting rows of the table with the given alias to the filter. pkgColumn
+// is the column of the table that holds the package name.
+func (f *queryFilter) where(alias, pkgColumn string) (string, []interface{}) {
+	var cond string
+	var args []interface{}
+	if f.window != 0 {
+		cond += " and " + alias + ".dateTime >= date_sub(now(), INTERVAL ? SECOND)"
+		args = append(args, f.window.Seconds())
+	}
+	if f.pkg != "" {
+		// "pkg/..." matches pkg and everything below it, like the go tool.
+		if strings.HasSuffix(f.pkg, "/...") {
+			prefix := strings.TrimSuffix(f.pkg, "/...")
+			cond += " and (" + alias + "." + pkgColumn + " = ? or " + alias + "." + pkgColumn + " like concat(?, '/%'))"
+			args = append(args, prefix, prefix)
+		} else {
+			cond += " and " + alias + "." + pkgColumn + " = ?"
+			args = append(args, f.pkg)
+		}
+	}
+	if f.status != "" {
+		cond += " and " + alias + ".result = ?"
+		args = append(args, f.status)
+	}
+	if f.label != "" {
+		cond += " and " + alias + ".runID in (select runID from runLabels where label = ?)"
+		args = append(args, f.label)
+	}
+	if f.branch != "" {
+		cond += " and " + alias + ".runID in (select id from runs where branch = ?)"
+		args = append(args, f.branch)
+	}
+	if f.since != nil {
+		cond += " and " + alias + ".dateTime >= ?"
+		args = append(args, f.since.dateTime)
+	}
+	if f.until != nil {
+		cond += " and " + alias + ".dateTime <= ?"
+		args = append(args, f.until.dateTime)
+	}
+	if f.run != nil {
+		cond += " and " + alias + ".runID = ?"
+		args = append(args, f.run.id)
+	}
+	if f.projects != nil {
+		cond += " and " + alias + ".project in (" + placeholders(len(f.projects)) + ")"
+		args = append(args, stringArgs(f.projects)...)
+	}
+	return cond, args
+}
+
+// runsWhere is like where for the runs table, whose ID column is id rather
+// than runID. Runs match the package and status filters if any of their tests
+// do.
+func (f *queryFilter) runsWhere() (string, []interface{}) {
+	var cond string
+	var args []interface{}
+	if f.pkg != "" || f.status != "" {
+		tf := &queryFilter{pkg: f.pkg, status: f.status}
+		tcond, targs := tf.where("ft", "packageName")
+		cond += " and r.id in (select ft.runID from tests ft where true" + tcond + ")"
+		args = append(args, targs...)
+	}
+	if f.window != 0 {
+		cond += " and r.dateTime >= date_sub(now(), INTERVAL ? SECOND)"
+		args = append(args, f.window.Seconds())
+	}
+	if f.label != "" {
+		cond += " and r.id in (select runID from runLabels where label = ?)"
+		args = append(args, f.label)
+	}
+	if f.branch != "" {
+		cond += " and r.branch = ?"
+		args = append(args, f.branch)
+	}
+	if f.since != nil {
+		cond += " and r.dateTime >= ?"
+		args = append(args, f.since.dateTime)
+	}
+	if f.until != nil {
+		cond += " and r.dateTime <= ?"
+		args = append(args, f.until.dateTime)
+	}
+	if f.run != nil {
+		cond += " and r.id = ?"
+		args = append(args, f.run.id)
+	}
+	if f.projects != nil {
+		cond += " and r.project in (" + placeholders(len(f.projects)) + ")"
+		args = append(args, stringArgs(f.projects)...)
+	}
+	return cond, args
+}
+
+// placeholders returns n comma separated SQL placeholders. An empty list
+// matches nothing, so n of zero gives a NULL.
+func placeholders(n int) string {
+	if n == 0 {
+		return "NULL"
+	}
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// stringArgs converts strings to SQL arguments.
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
+
+// count runs an SQL query counting rows and returns the count.
+func (env *Environment) count(query string, args ...interface{}) (int, error) {
+	var n int
+	err := env.db.QueryRow(query, args...).Scan(&n)
+	return n, err
+}
+
+// queryTable runs an SQL query and collects its rows into a table with the
+// given column names. Each row is scanned into values of the same types as
+// the given row template.
+func (env *Environment) queryTable(columns []string, template func() []interface{}, query string, args ...interface{}) (*table, error) {
+	rows, err := env.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	t := &table{columns: columns}
+	for rows.Next() {
+		dest := template()
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make([]interface{}, len(dest))
+		for i, d := range dest {
+			switch d := d.(type) {
+			case *string:
+				row[i] = *d
+			case *int64:
+				row[i] = *d
+			case *float64:
+				row[i] = *d
+			case *time.Time:
+				row[i] = *d
+			default:
+				return nil, fmt.Errorf("unsupported column type %T", d)
+			}
+		}
+		t.rows = append(t.rows, row)
+	}
+	return t, rows.Err()
+}
+
+// snippet shortens test output to a single line of at most
+// outputSnippetLength characters.
+func snippet(output string) string {
+	output = strings.Join(strings.Fields(output), " ")
+	if utf8.RuneCountInString(output) <= outputSnippetLength {
+		return output
+	}
+	return string([]rune(output)[:outputSnippetLength-3]) + "..."
+}
+
+// TestHistory returns every stored result of the named test in chronological
+// order, or in commit order with f.topo, with the run, commit, duration and a
+// snippet of its output.
+func (env *Environment) TestHistory(name string, f *queryFilter) (*table, error) {
+	cond, args := f.where("t", "packageName")
+	page, pageArgs := f.page()
+	t, err := env.queryTable(
+		[]string{"runID", "commitHash", "dateTime", "package", "result", "duration", "output"},
+		func() []interface{} {
+			return []interface{}{new(int64), new(string), new(time.Time), new(string), new(string), new(float64), new(string)}
+		},
+		"select t.runID, t.commitHash, t.dateTime, coalesce(t.packageName, ''), t.result, t.duration, coalesce(t.output, '') from tests t left join commits c on c.hash = t.commitHash where t.name = ?"+cond+f.orderBy("t", false)+", t.runID"+page+";",
+		append(append([]interface{}{name}, args...), pageArgs...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range t.rows {
+		row[6] = snippet(row[6].(string))
+	}
+	return t, nil
+}
+
+// TestHistoryCount returns the number of results TestHistory returns without
+// a limit.
+func (env *Environment) TestHistoryCount(name string, f *queryFilter) (int, error) {
+	cond, args := f.where("t", "packageName")
+	return env.count("select count(*) from tests t where t.name = ?"+cond+";", append([]interface{}{name}, args...)...)
+}
+
+// Runs returns every run, newest first by date time or, with f.topo, by
+// commit, with its branch, its labels and how many of its tests passed,
+// failed, were skipped or undetermined, and how many panics it had.
+func (env *Environment) Runs(f *queryFilter) (*table, error) {
+	cond, args := f.runsWhere()
+	page, pageArgs := f.page()
+	return env.queryTable(
+		[]string{"runID", "commitHash", "branch", "pullRequest", "targetBranch", "dateTime", "labels", "passed", "failed", "skipped", "undetermined", "panics"},
+		func() []interface{} {
+			return []interface{}{new(int64), new(string), new(string), new(int64), new(string), new(time.Time), new(string), new(int64), new(int64), new(int64), new(int64), new(int64)}
+		},
+		"select r.id, r.commitHash, coalesce(r.branch, ''), coalesce(r.pullRequest, 0), coalesce(r.targetBranch, ''), r.dateTime, coalesce((select group_concat(l.label order by l.label) from runLabels l where l.runID = r.id), ''),"+
+			" coalesce(sum(t.result='PASSED' and t.name != ?), 0), coalesce(sum(t.result='FAILED' and t.name != ?), 0), coalesce(sum(t.result='SKIPPED'), 0), coalesce(sum(t.result='UNDETERMINED'), 0), coalesce(sum(t.name = ?), 0)"+
+			" from runs r left join tests t on t.runID = r.id left join commits c on c.hash = r.commitHash where true"+cond+" group by r.id, r.commitHash, r.branch, r.pullRequest, r.targetBranch, r.dateTime, c.generation"+f.orderBy("r", true)+", r.id desc"+page+";",
+		append(append([]interface{}{panicTestName, panicTestName, panicTestName}, args...), pageArgs...)...,
+	)
+}
+
+// RunCount returns the number of runs Runs returns without a limit.
+func (env *Environment) RunCount(f *queryFilter) (int, error) {
+	cond, args := f.runsWhere()
+	return env.count("select count(*) from runs r where true"+cond+";", args...)
+}
+
+// Tests returns every stored test result, with a snippet of its output,
+// ordered by run, package and name.
+func (env *Environment) Tests(f *queryFilter) (*table, error) {
+	cond, args := f.where("t", "packageName")
+	page, pageArgs := f.page()
+	t, err := env.queryTable(
+		[]string{"runID", "name", "package", "result", "duration", "output"},
+		func() []interface{} {
+			return []interface{}{new(int64), new(string), new(string), new(string), new(float64), new(string)}
+		},
+		"select t.runID, t.name, coalesce(t.packageName, ''), t.result, t.duration, coalesce(t.output, '') from tests t where true"+cond+" order by t.runID, t.packageName, t.name"+page+";",
+		append(args, pageArgs...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range t.rows {
+		row[5] = snippet(row[5].(string))
+	}
+	return t, nil
+}
+
+// TestCount returns the number of results Tests returns without a limit.
+func (env *Environment) TestCount(f *queryFilter) (int, error) {
+	cond, args := f.where("t", "packageName")
+	return env.count("select count(*) from tests t where true"+cond+";", args...)
+}
+
+// Packages returns every stored package result, ordered by run and name.
+func (env *Environment) Packages(f *queryFilter) (*table, error) {
+	cond, args := f.where("p", "name")
+	page, pageArgs := f.page()
+	return env.queryTable(
+		[]string{"runID", "name", "result", "duration"},
+		func() []interface{} {
+			return []interface{}{new(int64), new(string), new(string), new(float64)}
+		},
+		"select p.runID, p.name, p.result, p.duration from packages p where true"+cond+" order by p.runID, p.name"+page+";",
+		append(args, pageArgs...)...,
+	)
+}
+
+// PackageCount returns the number of results Packages returns without a
+// limit.
+func (env *Environment) PackageCount(f *queryFilter) (int, error) {
+	cond, args := f.where("p", "name")
+	return env.count("select count(*) from packages p where true"+cond+";", args...)
+}
+
+// groupedSource returns the table and alias results are grouped from, the
+// expression they are grouped by, the columns it is returned as and the
+// package column filtered on. Tests are grouped by package as well as name,
+// since tests of different packages may share a name.
+func groupedSource(byPackage bool) (from, alias, group string, groupColumns []string, pkgColumn string) {
+	if byPackage {
+		return "packages p", "p", "p.name", []string{"name"}, "name"
+	}
+	return "tests t", "t", "coalesce(t.packageName, ''), t.name", []string{"package", "name"}, "packageName"
+}
+
+// groupedRow returns scan destinations for the grouping columns followed by
+// rest.
+func groupedRow(groupColumns []string, rest ...interface{}) []interface{} {
+	var dest []interface{}
+	for range groupColumns {
+		dest = append(dest, new(string))
+	}
+	return append(dest, rest...)
+}
+
+// PassRates returns how often each test, or each package, passed.
+func (env *Environment) PassRates(f *queryFilter, byPackage bool) (*table, error) {
+	from, alias, group, groupColumns, pkgColumn := groupedSource(byPackage)
+	cond, args := f.where(alias, pkgColumn)
+	return env.queryTable(
+		append(groupColumns, "runs", "passed", "failed", "skipped", "undetermined", "passRate"),
+		func() []interface{} {
+			return groupedRow(groupColumns, new(int64), new(int64), new(int64), new(int64), new(int64), new(float64))
+		},
+		"select "+group+", count(*), sum("+alias+".result='PASSED'), sum("+alias+".result='FAILED'), sum("+alias+".result='SKIPPED'), sum("+alias+".result='UNDETERMINED'), sum("+alias+".result='PASSED')/count(*) as passRate"+
+			" from "+from+" where "+alias+".name != ?"+cond+" group by "+group+" order by passRate, "+group+";",
+		append([]interface{}{panicTestName}, args...)...,
+	)
+}
+
+// Slowest returns the n tests, or packages, with the longest average duration
+// when they passed, since failures and skips often stop early.
+func (env *Environment) Slowest(f *queryFilter, byPackage bool, n int) (*table, error) {
+	from, alias, group, groupColumns, pkgColumn := groupedSource(byPackage)
+	cond, args := f.where(alias, pkgColumn)
+	return env.queryTable(
+		append(groupColumns, "runs", "avgDuration", "maxDuration"),
+		func() []interface{} {
+			return groupedRow(groupColumns, new(int64), new(float64), new(float64))
+		},
+		"select "+group+", count(*), avg("+alias+".duration) as avgDuration, max("+alias+".duration)"+
+			" from "+from+" where "+alias+".name != ? and "+alias+".result='PASSED'"+cond+" group by "+group+" order by avgDuration desc limit ?;",
+		append(append([]interface{}{panicTestName}, args...), n)...,
+	)
+}
+
+// MostFailing returns the n tests, or packages, that failed most often.
+func (env *Environment) MostFailing(f *queryFilter, byPackage bool, n int) (*table, error) {
+	from, alias, group, groupColumns, pkgColumn := groupedSource(byPackage)
+	cond, args := f.where(alias, pkgColumn)
+	return env.queryTable(
+		append(groupColumns, "runs", "failures", "lastFailure"),
+		func() []interface{} {
+			return groupedRow(groupColumns, new(int64), new(int64), new(time.Time))
+		},
+		"select "+group+", count(*), sum("+alias+".result='FAILED') as failures, max(case when "+alias+".result='FAILED' then "+alias+".dateTime end)"+
+			" from "+from+" where "+alias+".name != ?"+cond+" group by "+group+" having failures > 0 order by failures desc, "+group+" limit ?;",
+		append(append([]interface{}{panicTestName}, args...), n)...,
+	)
+}
+
+func init() {
+	commands["query"] = queryCommand
+}
+
+// queryCommand runs the "query" subcommand family: runs, tests, packages,
+// history, pass-rate, slowest, most-failing and durations.
+func queryCommand(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s query <runs|tests|packages|history|pass-rate|slowest|most-failing|durations> [flags] [test]\n", os.Args[0])
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	sub := args[0]
+
+	fs := flag.NewFlagSet("query "+sub, flag.ExitOnError)
+	dbInfoPtr := fs.String("dbinfo", "db-info.txt", "file in which db information is contained")
+	formatPtr := fs.String("format", "table", "output format: table, csv or json")
+	windowPtr := fs.String("window", "", "only consider results from this far back, e.g. 7d")
+	pkgPtr := fs.String("package", "", "only consider this package, or packages below it when ending in /...")
+	statusPtr := fs.String("status", "", "only consider results with this status, e.g. FAILED")
+	labelPtr := fs.String("label", "", "only consider runs with this label")
+	branchPtr := fs.String("branch", "", "only consider runs of this branch")
+	projectPtr := fs.String("project", "", "only consider runs of this project")
+	sincePtr := fs.String("since", "", "only consider results from this run or commit onwards")
+	untilPtr := fs.String("until", "", "only consider results up to this run or commit")
+	runPtr := fs.String("run", "", "only consider results of this run or commit")
+	byPtr := fs.String("by", "test", "group results by test or package")
+	nPtr := fs.Int("n", 10, "number of results for slowest and most-failing")
+	exactPtr := fs.Bool("exact", false, "compute durations from the raw results instead of the daily summaries")
+	orderPtr := fs.String("order", "time", "order runs and history by date time, or by commit topology with topo")
+	fs.Parse(args[1:])
+
+	// The profile only scopes branch refs given to -since, -until and -run.
+	env := openEnvironment(*dbInfoPtr, &Profile{Project: *projectPtr})
+	defer env.db.Close()
+
+	f := &queryFilter{pkg: *pkgPtr, label: *labelPtr, branch: *branchPtr}
+	if *projectPtr != "" {
+		f.projects = []string{*projectPtr}
+	}
+	var err error
+	if *windowPtr != "" {
+		if f.window, err = ParseWindow(*windowPtr); err != nil {
+			log.Fatal("Error parsing window: ", err)
+		}
+	}
+	if *statusPtr != "" {
+		status, err := ParseStatus(strings.ToUpper(*statusPtr))
+		if err != nil {
+			log.Fatal(err)
+		}
+		f.status = status.String()
+	}
+	if *sincePtr != "" {
+		if f.since, err = env.resolveRun(*sincePtr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *untilPtr != "" {
+		if f.until, err = env.resolveRun(*untilPtr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *runPtr != "" {
+		if f.run, err = env.resolveRun(*runPtr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch *orderPtr {
+	case "time":
+	case "topo":
+		f.topo = true
+	default:
+		log.Fatalf("Unknown order %q, expected time or topo", *orderPtr)
+	}
+	if *byPtr != "test" && *byPtr != "package" {
+		log.Fatalf("Unknown grouping %q, expected test or package", *byPtr)
+	}
+	byPackage := *byPtr == "package"
+
+	var t *table
+	switch sub {
+	case "runs":
+		t, err = env.Runs(f)
+	case "tests":
+		t, err = env.Tests(f)
+	case "packages":
+		t, err = env.Packages(f)
+	case "history":
+		if fs.NArg() != 1 {
+			usage()
+		}
+		t, err = env.TestHistory(fs.Arg(0), f)
+	case "pass-rate":
+		t, err = env.PassRates(f, byPackage)
+	case "slowest":
+		t, err = env.Slowest(f, byPackage, *nPtr)
+	case "most-failing":
+		t, err = env.MostFailing(f, byPackage, *nPtr)
+	case "durations":
+		t, err = env.DurationStats(f, byPackage, *exactPtr)
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal("Error querying database: ", err)
+	}
+	if err := t.write(os.Stdout, *formatPtr); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/marcinja/go-testdb/report"
+)
+
+// The default templates reproduce the standard update layout. Copies of them
+// make good starting points for custom templates.
+var (
+	//go:embed templates/update.txt.tmpl
+	defaultTextTemplate string
+
+	//go:embed templates/update.html.tmpl
+	defaultHTMLTemplate string
+)
+
+// reportFuncs are the functions available to both text and HTML report
+// templates.
+var reportFuncs = map[string]interface{}{
+	"formatTime": func(t time.Time) string { return t.Format(referenceTime) },
+	"float":      func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) },
+	"seconds":    func(s float64) string { return strconv.FormatFloat(s, 'f', -1, 64) + "s" },
+	"signed":     func(s float64) string { return fmt.Sprintf("%+.2fs", s) },
+	"percent":    func(f float64) string { return strconv.FormatFloat(f*100, 'f', 0, 64) },
+	"add":        func(a, b int) int { return a + b },
+	"shortHash":  shortHash,
+}
+
+// htmlReportFuncs are the functions available only to HTML report templates.
+var htmlReportFuncs = htmltemplate.FuncMap{
+	"sparkline":    sparkline,
+	"outcomeChart": outcomeChart,
+}
+
+// shortHash abbreviates a commit hash for display.
+func shortHash(hash string) string {
+	if len(hash) > 10 {
+		return hash[:10]
+	}
+	return hash
+}
+
+// reportTemplates renders a Report. The text template must define "subject"
+// and "body" templates; the HTML template renders a whole page.
+type reportTemplates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// loadReportTemplates parses the text and HTML templates at the given paths.
+// An empty path selects the default template.
+func loadReportTemplates(textPath, htmlPath string) (*reportTemplates, error) {
+	textSrc, err := templateSource(textPath, defaultTextTemplate)
+	if err != nil {
+		return nil, err
+	}
+	htmlSrc, err := templateSource(htmlPath, defaultHTMLTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := texttemplate.New("update").Funcs(reportFuncs).Parse(textSrc)
+	if err != nil {
+		return nil, fmt.Errorf("parsing text template: %v", err)
+	}
+	for _, name := range []string{"subject", "body"} {
+		if text.Lookup(name) == nil {
+			return nil, fmt.Errorf("text template does not define %q", name)
+		}
+	}
+	html, err := htmltemplate.New("update").Funcs(reportFuncs).Funcs(htmlReportFuncs).Parse(htmlSrc)
+	if err != nil {
+		return nil, fmt.Errorf("parsing HTML template: %v", err)
+	}
+	return &reportTemplates{text: text, html: html}, nil
+}
+
+// templateSource reads the template at path, or returns def if path is empty.
+func templateSource(path, def string) (string, error) {
+	if path == "" {
+		return def, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// subject renders the report's subject line.
+func (rt *reportTemplates) subject(r *report.Report) (string, error) {
+	var b bytes.Buffer
+	if err := rt.text.ExecuteTemplate(&b, "subject", r); err != nil {
+		return "", err
+	}
+	// Email subjects must be a single line.
+	return strings.Join(strings.Fields(b.String()), " "), nil
+}
+
+// body renders the report's plain text body.
+func (rt *reportTemplates) body(r *report.Report) (string, error) {
+	var b bytes.Buffer
+	if err := rt.text.ExecuteTemplate(&b, "body", r); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// writeHTML renders the report as an HTML page.
+func (rt *reportTemplates) writeHTML(w io.Writer, r *report.Report) error {
+	subject, err := rt.subject(r)
+	if err != nil {
+		return err
+	}
+	return rt.html.Execute(w, struct {
+		Subject string
+		*report.Report
+	}{subject, r})
+}
+
+// renderedReport holds every rendering of a report, and the report itself.
+type renderedReport struct {
+	subject string
+	body    string
+	html    string
+	report  *report.Report
+}
+
+// render renders the report's subject, plain text body and HTML page.
+func (rt *reportTemplates) render(r *report.Report) (*renderedReport, error) {
+	subject, err := rt.subject(r)
+	if err != nil {
+		return nil, err
+	}
+	body, err := rt.body(r)
+	if err != nil {
+		return nil, err
+	}
+	var html bytes.Buffer
+	if err := rt.writeHTML(&html, r); err != nil {
+		return nil, err
+	}
+	return &renderedReport{subject: subject, body: body, html: html.String(), report: r}, nil
+}
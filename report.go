@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcinja/go-testdb/report"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// gatherReport runs every analysis for the environment's profile and collects
+// the results into a Report.
+func (env *Environment) gatherReport() (*report.Report, error) {
+	p := env.profile
+	r := &report.Report{
+		SchemaVersion:   report.SchemaVersion,
+		Profile:         p.Name,
+		Window:          p.Window.String(),
+		PerfChangeRatio: p.PerfChangeRatio,
+		Generated:       time.Now(),
+	}
+
+	runs, err := env.runOutcomesFromWindow()
+	if err != nil {
+		return nil, fmt.Errorf("selecting runs: %v", err)
+	}
+	r.Runs = runs
+
+	panics, err := env.reportPanics()
+	if err != nil {
+		return nil, fmt.Errorf("selecting panic results: %v", err)
+	}
+	r.Panics = panics
+
+	failures, err := env.reportFailures()
+	if err != nil {
+		return nil, fmt.Errorf("selecting failed results: %v", err)
+	}
+	r.Failures = failures
+	r.Clusters = clusterFailures(r.Failures)
+	r.FailuresByOwner = groupFailuresByOwner(r.Failures)
+	if p.Repo != "" {
+		// The impact of changes is left out rather than stopping the
+		// update, which a daemon would otherwise never send.
+		impacts, err := env.reportImpacts(r.Failures, p.Repo)
+		if err != nil {
+			log.Println("Error analysing the impact of changes: ", err)
+		}
+		r.Impacts = impacts
+	}
+
+	flaky, err := env.flakyTestsBetween(p.Window, 0)
+	if err != nil {
+		return nil, fmt.Errorf("selecting flaky tests: %v", err)
+	}
+	r.Flaky = flaky
+
+	perfDiffs, err := env.reportPerfDiffs()
+	if err != nil {
+		return nil, fmt.Errorf("finding performance changes: %v", err)
+	}
+	r.PerfDiffs = perfDiffs
+
+	inventory, err := env.inventoryChangesFromBaseline()
+	if err != nil {
+		return nil, fmt.Errorf("comparing test inventory: %v", err)
+	}
+	r.VanishedPackages = inventory.vanishedPackages
+	for _, t := range inventory.vanishedTests {
+		r.VanishedTests = append(r.VanishedTests, &report.InventoryTest{Name: t.name, Package: t.pkg})
+	}
+	for _, t := range inventory.newTests {
+		r.NewTests = append(r.NewTests, &report.InventoryTest{Name: t.name, Package: t.pkg})
+	}
+	for _, jump := range inventory.skipJumps {
+		r.SkipJumps = append(r.SkipJumps, &report.SkipJump{
+			Name:         jump.name,
+			Package:      jump.pkg,
+			BaselineRate: jump.baselineRate,
+			RecentRate:   jump.recentRate,
+		})
+	}
+	return r, nil
+}
+
+// reportPanics returns the panics within the profile's window.
+func (env *Environment) reportPanics() ([]*report.Panic, error) {
+	results, err := env.panicsFromWindow()
+	if err != nil {
+		return nil, err
+	}
+	var panics []*report.Panic
+	for _, pr := range results {
+		panics = append(panics, &report.Panic{
+			RunID:    pr.runID,
+			DateTime: pr.dateTime,
+			Package:  pr.pkg,
+		})
+	}
+	return panics, nil
+}
+
+// reportFailures returns the failures within the profile's window, with the
+// owners recorded for their packages.
+func (env *Environment) reportFailures() ([]*report.Failure, error) {
+	owners, err := env.ownersFromWindow()
+	if err != nil {
+		return nil, err
+	}
+	results, err := env.failedTestsFromWindow()
+	if err != nil {
+		return nil, err
+	}
+	var failures []*report.Failure
+	for i, fr := range results {
+		failures = append(failures, &report.Failure{
+			ID:         "failure-" + strconv.Itoa(i+1),
+			RunID:      fr.runID,
+			Name:       fr.name,
+			Package:    fr.pkg,
+			CommitHash: fr.commitHash,
+			DateTime:   fr.dateTime,
+			Duration:   fr.duration.Seconds(),
+			Output:     fr.output,
+			Owners:     owners[fr.runID][fr.pkg],
+		})
+	}
+	return failures, nil
+}
+
+// reportPerfDiffs returns the performance changes from the profile's
+// baseline, with the passing durations of each test over the baseline.
+func (env *Environment) reportPerfDiffs() ([]*report.PerfChange, error) {
+	diffs, err := env.performanceDiffsFromBaseline()
+	if err != nil {
+		return nil, err
+	}
+	var changes []*report.PerfChange
+	for _, diff := range diffs {
+		history, err := env.passingDurations(diff.testID, env.profile.Baseline)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, &report.PerfChange{
+			Name:    diff.name,
+			Package: diff.pkg,
+			Change:  diff.performanceChange,
+			History: history,
+		})
+	}
+	return changes, nil
+}
+
+// runOutcomesFromWindow summarizes every run within the profile's window,
+// with what its commit changed when that is known. Runs are in commit order
+// when every run's commit was read from a checkout, and oldest first
+// otherwise.
+func (env *Environment) runOutcomesFromWindow() ([]*report.Run, error) {
+	rows, err := env.db.Query("select r.id, r.commitHash, r.dateTime, sum(t.result='PASSED' and t.name != ?), sum(t.result='FAILED' and t.name != ?), sum(t.result='SKIPPED'), sum(t.result='UNDETERMINED'), sum(t.name = ?), coalesce(c.author, ''), coalesce(c.subject, ''), coalesce(c.generation, 0) from runs r join tests t on t.runID = r.id left join commits c on c.hash = r.commitHash where r.dateTime between date_sub(now(), INTERVAL ? SECOND) and now() and "+runScopeFilter+" group by r.id, r.commitHash, r.dateTime, c.author, c.subject, c.generation order by r.dateTime;", append([]interface{}{panicTestName, panicTestName, panicTestName, env.profile.Window.Seconds()}, env.scopeArgs()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []*report.Run
+	generations := make(map[*report.Run]int64)
+	topological := true
+	for rows.Next() {
+		r := &report.Run{}
+		var generation int64
+		if err := rows.Scan(&r.ID, &r.CommitHash, &r.DateTime, &r.Passed, &r.Failed, &r.Skipped, &r.Undetermined, &r.Panics, &r.Author, &r.Subject, &generation); err != nil {
+			return nil, err
+		}
+		generations[r] = generation
+		topological = topological && generation != 0
+		runs = append(runs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if topological {
+		sort.SliceStable(runs, func(i, j int) bool { return generations[runs[i]] < generations[runs[j]] })
+	}
+	if err := env.addChangedFiles(runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// addChangedFiles fills in the files changed by the commits of runs whose
+// commits were read from a checkout.
+func (env *Environment) addChangedFiles(runs []*report.Run) error {
+	byHash := make(map[string][]*report.Run)
+	var hashes []string
+	for _, r := range runs {
+		if r.Subject == "" && r.Author == "" {
+			continue
+		}
+		if _, ok := byHash[r.CommitHash]; !ok {
+			hashes = append(hashes, r.CommitHash)
+		}
+		byHash[r.CommitHash] = append(byHash[r.CommitHash], r)
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	rows, err := env.db.Query("select hash, path from commitFiles where hash in ("+placeholders(len(hashes))+") order by hash, path;", stringArgs(hashes)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash, path string
+		if err := rows.Scan(&hash, &path); err != nil {
+			return err
+		}
+		for _, r := range byHash[hash] {
+			r.ChangedFiles = append(r.ChangedFiles, path)
+		}
+	}
+	return rows.Err()
+}
+
+// passingDurations returns the durations, in seconds, of every passing result
+// of the test within the given window, oldest first.
+func (env *Environment) passingDurations(t testID, window Window) ([]float64, error) {
+	rows, err := env.db.Query("select duration from tests where datetime between date_sub(now(), INTERVAL ? SECOND) and now() and coalesce(packageName, '') = ? and name = ? and result='PASSED' and "+scopeFilter+" order by dateTime;", append([]interface{}{window.Seconds(), t.pkg, t.name}, env.scopeArgs()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var durations []float64
+	for rows.Next() {
+		var d float64
+		if err := rows.Scan(&d); err != nil {
+			return nil, err
+		}
+		durations = append(durations, d)
+	}
+	return durations, rows.Err()
+}
+
+var (
+	// hexPattern and numberPattern match the parts of test output that tend
+	// to differ between otherwise identical failures.
+	hexPattern    = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+	numberPattern = regexp.MustCompile(`[0-9]+`)
+)
+
+// maxSignatureLength is the length at which failure signatures are cut off.
+const maxSignatureLength = 120
+
+// failureSignature reduces a failure's output to a string that is shared by
+// failures with the same cause: the first line of output, with addresses and
+// numbers masked. Stored output keeps the tab each line began with, so tabs
+// also separate lines.
+func failureSignature(output string) string {
+	var first string
+	lines := strings.FieldsFunc(output, func(r rune) bool { return r == '\n' || r == '\t' })
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			first = line
+			break
+		}
+	}
+	if first == "" {
+		return "(no output)"
+	}
+	first = hexPattern.ReplaceAllString(first, "ADDR")
+	first = numberPattern.ReplaceAllString(first, "N")
+	if len(first) > maxSignatureLength {
+		first = first[:maxSignatureLength] + "..."
+	}
+	return first
+}
+
+// clusterFailures groups failures by signature, largest cluster first.
+func clusterFailures(failures []*report.Failure) []*report.FailureCluster {
+	bySignature := make(map[string]*report.FailureCluster)
+	var clusters []*report.FailureCluster
+	for _, f := range failures {
+		sig := failureSignature(f.Output)
+		c, ok := bySignature[sig]
+		if !ok {
+			c = &report.FailureCluster{Signature: sig}
+			bySignature[sig] = c
+			clusters = append(clusters, c)
+		}
+		c.Failures = append(c.Failures, f)
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return len(clusters[i].Failures) > len(clusters[j].Failures)
+	})
+	return clusters
+}
+
+// writeReportJSON writes the report as indented JSON.
+func writeReportJSON(w io.Writer, r *report.Report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(r)
+}
+
+// writeReportYAML writes the report as YAML.
+func writeReportYAML(w io.Writer, r *report.Report) error {
+	b, err := yaml.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
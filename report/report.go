@@ -0,0 +1,178 @@
+// Package report defines the data gathered for a go-testdb update. It is the
+// model rendered by the update's text and HTML templates, and the schema of
+// its JSON and YAML output, so that other tools can decode updates with:
+//
+//	var r report.Report
+//	err := json.Unmarshal(data, &r)
+//
+// Durations are in seconds and times are in RFC 3339 format. Fields are only
+// ever added within a schema version; renaming, removing or changing the
+// meaning of a field increments SchemaVersion.
+package report
+
+import "time"
+
+// SchemaVersion is the version of the layout described by this package. It is
+// written to every Report.
+const SchemaVersion = 1
+
+// Report holds everything found for an update.
+type Report struct {
+	SchemaVersion int `json:"schemaVersion" yaml:"schemaVersion"`
+
+	// Profile is the name of the profile the update was made with, and
+	// Window how far back it looked, e.g. "1d".
+	Profile         string    `json:"profile" yaml:"profile"`
+	Window          string    `json:"window" yaml:"window"`
+	PerfChangeRatio float64   `json:"perfChangeRatio" yaml:"perfChangeRatio"`
+	Generated       time.Time `json:"generated" yaml:"generated"`
+
+	// Subscription names the subscription a digest was filtered for. It is
+	// empty for the full update.
+	Subscription string `json:"subscription,omitempty" yaml:"subscription,omitempty"`
+
+	Runs      []*Run            `json:"runs" yaml:"runs"`
+	Panics    []*Panic          `json:"panics" yaml:"panics"`
+	Failures  []*Failure        `json:"failures" yaml:"failures"`
+	Clusters  []*FailureCluster `json:"clusters" yaml:"clusters"`
+	Flaky     []*FlakyTest      `json:"flaky" yaml:"flaky"`
+	PerfDiffs []*PerfChange     `json:"perfDiffs" yaml:"perfDiffs"`
+
+	// FailuresByOwner groups Failures by owner. It is empty unless owners
+	// were recorded for at least one failure.
+	FailuresByOwner []*OwnerFailures `json:"failuresByOwner" yaml:"failuresByOwner"`
+
+	// Impacts link each newly failing test to the changes since it last
+	// passed. They are only found when the profile names a repo.
+	Impacts []*Impact `json:"impacts,omitempty" yaml:"impacts,omitempty"`
+
+	VanishedPackages []string         `json:"vanishedPackages" yaml:"vanishedPackages"`
+	VanishedTests    []*InventoryTest `json:"vanishedTests" yaml:"vanishedTests"`
+	NewTests         []*InventoryTest `json:"newTests" yaml:"newTests"`
+	SkipJumps        []*SkipJump      `json:"skipJumps" yaml:"skipJumps"`
+}
+
+// Run summarizes the outcome of a single run.
+type Run struct {
+	ID           int64     `json:"id" yaml:"id"`
+	CommitHash   string    `json:"commitHash" yaml:"commitHash"`
+	DateTime     time.Time `json:"dateTime" yaml:"dateTime"`
+	Passed       int       `json:"passed" yaml:"passed"`
+	Failed       int       `json:"failed" yaml:"failed"`
+	Skipped      int       `json:"skipped" yaml:"skipped"`
+	Undetermined int       `json:"undetermined" yaml:"undetermined"`
+	Panics       int       `json:"panics" yaml:"panics"`
+
+	// Author, Subject and ChangedFiles describe the run's commit when it
+	// was read from a git checkout.
+	Author       string   `json:"author,omitempty" yaml:"author,omitempty"`
+	Subject      string   `json:"subject,omitempty" yaml:"subject,omitempty"`
+	ChangedFiles []string `json:"changedFiles,omitempty" yaml:"changedFiles,omitempty"`
+}
+
+// Panic is a panic that occured during a run.
+type Panic struct {
+	RunID    int64     `json:"runID" yaml:"runID"`
+	DateTime time.Time `json:"dateTime" yaml:"dateTime"`
+	Package  string    `json:"package" yaml:"package"`
+}
+
+// Failure is a single failed test.
+type Failure struct {
+	// ID is unique within the report, so that the failure can be referred
+	// to, e.g. from a FailureCluster.
+	ID         string    `json:"id" yaml:"id"`
+	RunID      int64     `json:"runID" yaml:"runID"`
+	Name       string    `json:"name" yaml:"name"`
+	Package    string    `json:"package" yaml:"package"`
+	CommitHash string    `json:"commitHash" yaml:"commitHash"`
+	DateTime   time.Time `json:"dateTime" yaml:"dateTime"`
+	Duration   float64   `json:"duration" yaml:"duration"`
+	Output     string    `json:"output" yaml:"output"`
+
+	// Owners are the owners recorded for the failure's package when its
+	// run was inserted.
+	Owners []string `json:"owners" yaml:"owners"`
+}
+
+// OwnerFailures lists the failures in packages owned by Owner. An empty Owner
+// holds the failures whose packages have no owner.
+type OwnerFailures struct {
+	Owner    string     `json:"owner" yaml:"owner"`
+	Failures []*Failure `json:"failures" yaml:"failures"`
+}
+
+// FailureCluster groups failures whose output looks alike, which usually means
+// they share a cause. Signature is the failures' first line of output with
+// addresses and numbers masked.
+type FailureCluster struct {
+	Signature string     `json:"signature" yaml:"signature"`
+	Failures  []*Failure `json:"failures" yaml:"failures"`
+}
+
+// Impact is the evidence that the changes between LastPassCommit and
+// FailingCommit could have broken a test. Verdict is "regression" when any
+// change could affect the test, and "flake" when none could, for example when
+// the test passed at the failing commit. Evidence is ranked most likely
+// first.
+type Impact struct {
+	Name           string            `json:"name" yaml:"name"`
+	Package        string            `json:"package" yaml:"package"`
+	FailingCommit  string            `json:"failingCommit" yaml:"failingCommit"`
+	LastPassCommit string            `json:"lastPassCommit" yaml:"lastPassCommit"`
+	Commits        int               `json:"commits" yaml:"commits"`
+	Verdict        string            `json:"verdict" yaml:"verdict"`
+	Evidence       []*ImpactEvidence `json:"evidence" yaml:"evidence"`
+}
+
+// ImpactEvidence is a changed file that could affect a failing test. Package
+// is the package the file belongs to, and Distance the number of imports
+// between the test's package and it: 0 for the test's own package. Score,
+// from 0 to 1, is higher the more directly the change could affect the test.
+type ImpactEvidence struct {
+	Path     string  `json:"path" yaml:"path"`
+	Commit   string  `json:"commit" yaml:"commit"`
+	Subject  string  `json:"subject" yaml:"subject"`
+	Package  string  `json:"package,omitempty" yaml:"package,omitempty"`
+	Distance int     `json:"distance" yaml:"distance"`
+	Score    float64 `json:"score" yaml:"score"`
+	Reason   string  `json:"reason" yaml:"reason"`
+}
+
+// FlakyTest is a test that both passed and failed on the same commit within
+// the window. Score is the fraction of consecutive results that flipped
+// between passing and failing, from 0 to 1.
+type FlakyTest struct {
+	Name         string  `json:"name" yaml:"name"`
+	Package      string  `json:"package" yaml:"package"`
+	Runs         int     `json:"runs" yaml:"runs"`
+	Failures     int     `json:"failures" yaml:"failures"`
+	FlakyCommits int     `json:"flakyCommits" yaml:"flakyCommits"`
+	Score        float64 `json:"score" yaml:"score"`
+}
+
+// PerfChange is a test whose average duration at the most recent commit
+// differs from its baseline average by Change seconds. Package is the package
+// the test most recently ran in. History holds the durations of its passing
+// results over the baseline, oldest first.
+type PerfChange struct {
+	Name    string    `json:"name" yaml:"name"`
+	Package string    `json:"package" yaml:"package"`
+	Change  float64   `json:"change" yaml:"change"`
+	History []float64 `json:"history" yaml:"history"`
+}
+
+// InventoryTest is a test that stopped running or is new.
+type InventoryTest struct {
+	Name    string `json:"name" yaml:"name"`
+	Package string `json:"package" yaml:"package"`
+}
+
+// SkipJump is a test that is skipped more often than it used to be. The rates
+// are the fraction of its runs in which it was skipped.
+type SkipJump struct {
+	Name         string  `json:"name" yaml:"name"`
+	Package      string  `json:"package" yaml:"package"`
+	BaselineRate float64 `json:"baselineRate" yaml:"baselineRate"`
+	RecentRate   float64 `json:"recentRate" yaml:"recentRate"`
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// streamParser parses the output of a running `go test` a line at a time,
+// giving the results of each package as soon as it is done.
+type streamParser struct {
+	format string
+
+	// lines are the text output of the package being run. `go test`
+	// prints the output of each package together when it runs several, so
+	// everything since the last package's result line belongs to the next.
+	lines []string
+
+	// events are the unparsed `go test -json` events of each unfinished
+	// package, and started the unfinished packages in the order they started.
+	events  map[string][]string
+	started []string
+}
+
+// newStreamParser returns a parser for output in the given format, text or
+// test2json.
+func newStreamParser(format string) *streamParser {
+	return &streamParser{format: format, events: make(map[string][]string)}
+}
+
+// line parses the next line of output, without its newline, and returns the
+// results of the package it finishes, or nil if it doesn't finish one.
+func (p *streamParser) line(s string) (*Result, error) {
+	if p.format == test2jsonLogFormat {
+		return p.event(s)
+	}
+
+	pkg, ok := parsePackageResult(s)
+	if !ok {
+		p.lines = append(p.lines, s)
+		return nil, nil
+	}
+	lines := p.lines
+	p.lines = nil
+	if pkg == nil {
+		return nil, nil
+	}
+	return textPackageResults(lines, pkg)
+}
+
+// event parses the next `go test -json` event.
+func (p *streamParser) event(s string) (*Result, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, nil
+	}
+	var e testEvent
+	if err := json.Unmarshal([]byte(s), &e); err != nil {
+		return nil, err
+	}
+	if e.Package == "" {
+		// Build output is archived, but not stored.
+		return nil, nil
+	}
+	if _, ok := p.events[e.Package]; !ok {
+		p.started = append(p.started, e.Package)
+	}
+	p.events[e.Package] = append(p.events[e.Package], s)
+	if e.Test != "" || (e.Action != "pass" && e.Action != "fail" && e.Action != "skip") {
+		return nil, nil
+	}
+	return p.flushPackage(e.Package)
+}
+
+// flushPackage parses and forgets the events of a package.
+func (p *streamParser) flushPackage(pkg string) (*Result, error) {
+	events := p.events[pkg]
+	delete(p.events, pkg)
+	for i, started := range p.started {
+		if started == pkg {
+			p.started = append(p.started[:i], p.started[i+1:]...)
+			break
+		}
+	}
+	return ParseTest2JSON(strings.NewReader(strings.Join(events, "\n")))
+}
+
+// finish returns the results of the packages that started but never finished,
+// because `go test` crashed or was interrupted. Their tests that didn't finish
+// are undetermined, as are the packages themselves. Text output doesn't name a
+// package until it is done, so its tests are left without one.
+func (p *streamParser) finish() ([]*Result, error) {
+	if p.format != test2jsonLogFormat {
+		if len(p.lines) == 0 {
+			return nil, nil
+		}
+		results, err := textPackageResults(p.lines, nil)
+		p.lines = nil
+		if err != nil {
+			return nil, err
+		}
+		if len(results.testResults) == 0 {
+			return nil, nil
+		}
+		return []*Result{results}, nil
+	}
+
+	var unfinished []*Result
+	for len(p.started) > 0 {
+		pkg := p.started[0]
+		results, err := p.flushPackage(pkg)
+		if err != nil {
+			return unfinished, err
+		}
+		results.packageResults = append(results.packageResults, &PackageResult{name: pkg, result: UNDETERMINED})
+		unfinished = append(unfinished, results)
+	}
+	return unfinished, nil
+}
+
+// textPackageResults parses the text output of a single package with the
+// given result, or of an unknown package if pkg is nil.
+func textPackageResults(lines []string, pkg *PackageResult) (*Result, error) {
+	results, err := parseLogLines(lines, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	results.packageResults = nil
+	if pkg != nil {
+		for _, t := range results.testResults {
+			t.pkg = pkg.name
+		}
+		results.packageResults = []*PackageResult{pkg}
+	}
+	return results, nil
+}
+
+// testRunner runs `go test` and stores its results as a single run.
+type testRunner struct {
+	env    *Environment
+	meta   *runMetadata
+	parser *streamParser
+
+	runID      int64
+	commitHash string
+	dateTime   time.Time
+
+	// packages is the number of packages stored so far.
+	packages int
+}
+
+// store records the results of one or more packages as part of the run.
+func (r *testRunner) store(results *Result) {
+	applyRunMetadata(results, r.meta)
+	results.commitHash = r.commitHash
+	results.dateTime = r.dateTime
+	if err := r.env.insertRunResults(r.runID, results, r.meta); err != nil {
+		fmt.Fprintln(os.Stderr, "Error inserting results: ", err)
+		return
+	}
+	r.packages += len(results.packageResults)
+}
+
+// copyOutput copies the output of `go test` to w, storing the results of each
+// package as it finishes, until the output ends.
+func (r *testRunner) copyOutput(output io.Reader, w io.Writer) error {
+	br := bufio.NewReader(output)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+			results, err := r.parser.line(strings.TrimRight(line, "\r\n"))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error parsing test output: ", err)
+			} else if results != nil {
+				r.store(results)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// finish stores the results of packages that never finished and refreshes the
+// duration summaries of the run's day.
+func (r *testRunner) finish() {
+	unfinished, err := r.parser.finish()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error parsing test output: ", err)
+	}
+	for _, results := range unfinished {
+		r.store(results)
+	}
+	if err := r.env.refreshDailyAggregates(r.dateTime); err != nil {
+		fmt.Fprintln(os.Stderr, "Error refreshing duration summaries: ", err)
+	}
+}
+
+// usesJSON reports whether a go test command line asks for `-json` output.
+func usesJSON(args []string) bool {
+	for _, a := range args {
+		if a == "--" || a == "-args" || a == "--args" {
+			break
+		}
+		if a == "-json" || a == "--json" || a == "-json=true" || a == "--json=true" {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	commands["run"] = runCommand
+}
+
+// runCommand runs the "run" subcommand, which runs `go test` and stores its
+// results as they arrive.
+func runCommand(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	dbInfoPtr := fs.String("dbinfo", "db-info.txt", "file in which db information is contained")
+	configPtr := fs.String("config", "", "JSON file containing project settings")
+	archivePtr := fs.String("archive", ".", "directory the test log is archived in")
+	mf := addRunMetadataFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s run [flags] -- go test [build/test flags] [packages]\n\nRuns the tests, storing their results as each package finishes.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	command := fs.Args()
+
+	cfg, err := LoadConfig(*configPtr)
+	if err != nil {
+		log.Fatal("Error loading config: ", err)
+	}
+	meta := mf.load()
+	cfg.applyProject(meta)
+
+	format := meta.format
+	if format == "" {
+		format = textLogFormat
+		if usesJSON(command) {
+			format = test2jsonLogFormat
+		}
+	}
+	if format != textLogFormat && format != test2jsonLogFormat {
+		log.Fatalf("Can't read %v output as it streams, use text or test2json", format)
+	}
+
+	commitHash := meta.commitHash
+	if commitHash == "" {
+		repo := meta.repo
+		if repo == "" {
+			repo = "."
+		}
+		out, err := gitOutput(repo, "rev-parse", "HEAD")
+		if err != nil {
+			log.Fatal("Error finding the commit under test, give it with -commit: ", err)
+		}
+		commitHash = strings.TrimSpace(out)
+	}
+	dateTime := meta.dateTime
+	if dateTime.IsZero() {
+		dateTime = time.Now().Truncate(time.Second)
+	}
+
+	// Both streams share a pipe, so that build errors are archived in
+	// order with the tests' output.
+	output, pw, err := os.Pipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+
+	// Interrupts are passed on rather than obeyed, so that the results
+	// written up to the end are stored.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	env := openEnvironment(*dbInfoPtr, nil)
+	if err := cmd.Start(); err != nil {
+		log.Fatal("Error starting tests: ", err)
+	}
+	pw.Close()
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	abort := func(v ...interface{}) {
+		cmd.Process.Kill()
+		log.Fatal(v...)
+	}
+
+	// The log is archived under the name `-dir` expects, so that it can be
+	// inserted again if the database is rebuilt.
+	ext := ".log"
+	if format == test2jsonLogFormat {
+		ext = ".json"
+	}
+	archivePath, err := filepath.Abs(filepath.Join(*archivePtr, "error-"+dateTime.Format(referenceTime)+ext))
+	if err != nil {
+		abort(err)
+	}
+	archive, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		abort("Error creating test log: ", err)
+	}
+	if format == textLogFormat {
+		fmt.Fprintf(archive, "%v\n%v\n", commitHashLine, commitHash)
+	}
+
+	results := &Result{commitHash: commitHash, dateTime: dateTime}
+	runID, err := env.startRun(results, meta)
+	if err != nil {
+		abort("Error inserting run: ", err)
+	}
+	// A watcher of the archive directory mustn't insert the run again.
+	if err := env.recordIngestedFile(archivePath, runID); err != nil {
+		fmt.Fprintln(os.Stderr, "Error recording test log: ", err)
+	}
+	r := &testRunner{
+		env:        env,
+		meta:       meta,
+		parser:     newStreamParser(format),
+		runID:      runID,
+		commitHash: results.commitHash,
+		dateTime:   dateTime,
+	}
+	if err := r.copyOutput(output, io.MultiWriter(os.Stdout, archive)); err != nil {
+		fmt.Fprintln(os.Stderr, "Error copying test output: ", err)
+		io.Copy(os.Stdout, output)
+	}
+	output.Close()
+
+	// Failing tests make `go test` exit with 1, which is passed on. Any
+	// other ending, such as being killed, is noted in the log.
+	exitCode := 0
+	waitErr := cmd.Wait()
+	signal.Stop(signals)
+	close(signals)
+	if exitErr, ok := waitErr.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		exitCode = exitErr.ExitCode()
+	} else if waitErr != nil {
+		exitCode = 1
+		fmt.Fprintf(archive, "%v: %v\n", command[0], waitErr)
+		fmt.Fprintf(os.Stderr, "%v: %v\n", command[0], waitErr)
+	}
+	r.finish()
+	if err := archive.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing test log: ", err)
+	}
+	env.db.Close()
+	fmt.Fprintf(os.Stderr, "Stored %d packages as run %d, logged to %v.\n", r.packages, runID, archivePath)
+	os.Exit(exitCode)
+}
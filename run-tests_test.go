@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestStreamParserText(t *testing.T) {
+	p := newStreamParser(textLogFormat)
+	var results []*Result
+	for _, line := range []string{
+		"=== RUN   TestPass",
+		"--- PASS: TestPass (0.10s)",
+		"=== RUN   TestFail",
+		"--- FAIL: TestFail (0.20s)",
+		"\tfoo_test.go:10: broken",
+		"FAIL",
+		"FAIL\texample.com/foo\t0.300s",
+		"?   \texample.com/cmd\t[no test files]",
+		"=== RUN   TestHang",
+	} {
+		r, err := p.line(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != nil {
+			results = append(results, r)
+		}
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d package results, want 1", len(results))
+	}
+	r := results[0]
+	if len(r.packageResults) != 1 || r.packageResults[0].name != "example.com/foo" || r.packageResults[0].result != FAILED {
+		t.Errorf("package results = %+v, want example.com/foo failed", r.packageResults)
+	}
+	want := map[string]Status{"TestPass": PASSED, "TestFail": FAILED}
+	if len(r.testResults) != len(want) {
+		t.Fatalf("got %d test results, want %d", len(r.testResults), len(want))
+	}
+	for _, tr := range r.testResults {
+		if tr.result != want[tr.name] || tr.pkg != "example.com/foo" {
+			t.Errorf("%v = %v in %q, want %v in example.com/foo", tr.name, tr.result, tr.pkg, want[tr.name])
+		}
+		if tr.name == "TestFail" && tr.output != "\tfoo_test.go:10: broken" {
+			t.Errorf("TestFail output = %q, want its log line", tr.output)
+		}
+	}
+
+	unfinished, err := p.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unfinished) != 1 || len(unfinished[0].testResults) != 1 || unfinished[0].testResults[0].result != UNDETERMINED {
+		t.Errorf("unfinished = %+v, want TestHang undetermined", unfinished)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// run identifies the results stored from a single test log.
+type run struct {
+	id         int64
+	commitHash string
+	dateTime   time.Time
+	project    string
+}
+
+// runMetadata holds information about a run that isn't found in its log.
+type runMetadata struct {
+	labels []string
+
+	// commitHash and dateTime, when set, replace those read from the log.
+	commitHash string
+	dateTime   time.Time
+
+	// branch is the branch that was tested, if known.
+	branch string
+
+	// pullRequest is the number of the pull request that was tested, or 0,
+	// and targetBranch the branch it is to be merged into.
+	pullRequest  int
+	targetBranch string
+
+	// project is the project the run belongs to, if any.
+	project string
+
+	// packagePrefix, when set, is trimmed from the run's package names.
+	packagePrefix string
+
+	// format is the format of the log: "text", "junit", or "" to choose by
+	// file extension.
+	format string
+
+	// owners, when set, are used to record the owners of the run's
+	// packages.
+	owners ownerRules
+
+	// repo, when set, is a git checkout the run's commit is read from.
+	repo string
+}
+
+// parseLabels splits a comma separated list of labels, dropping empty ones.
+func parseLabels(s string) []string {
+	var labels []string
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+// parseRunTime parses a run's date time given on the command line, either in
+// the format used in log file names or RFC 3339.
+func parseRunTime(s string) (time.Time, error) {
+	if t, err := time.Parse(referenceTime, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad run time %q: use 2006-01-02-15:04:05 or RFC 3339", s)
+	}
+	return t, nil
+}
+
+// insertRun records a new run and returns its ID.
+func (env *Environment) insertRun(commitHash string, dateTime time.Time, meta *runMetadata) (int64, error) {
+	var branch, targetBranch, project sql.NullString
+	var pullRequest sql.NullInt64
+	if meta != nil && meta.branch != "" {
+		branch = sql.NullString{String: meta.branch, Valid: true}
+	}
+	if meta != nil && meta.pullRequest != 0 {
+		pullRequest = sql.NullInt64{Int64: int64(meta.pullRequest), Valid: true}
+	}
+	if meta != nil && meta.targetBranch != "" {
+		targetBranch = sql.NullString{String: meta.targetBranch, Valid: true}
+	}
+	if meta != nil && meta.project != "" {
+		project = sql.NullString{String: meta.project, Valid: true}
+	}
+	// The run and its labels are inserted together, so that a run is
+	// never found without them.
+	tx, err := env.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("INSERT runs SET commitHash=?,dateTime=?,branch=?,pullRequest=?,targetBranch=?,project=?", commitHash, dateTime, branch, pullRequest, targetBranch, project)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if meta != nil {
+		for _, label := range meta.labels {
+			if _, err := tx.Exec("INSERT runLabels SET runID=?,label=?", id, label); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// deleteRun deletes a run inserted at the given date time, with its labels,
+// owners and results, and refreshes the duration summaries of its day.
+func (env *Environment) deleteRun(runID int64, dateTime time.Time) error {
+	tx, err := env.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"tests", "packages", "runLabels", "runOwners"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE runID=?", runID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM runs WHERE id=?", runID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return env.refreshDailyAggregates(dateTime)
+}
+
+// errNoRun is returned, wrapped, when a ref doesn't refer to any stored run.
+var errNoRun = errors.New("no run")
+
+// resolveRun finds the run referred to by ref. A ref may be "run:<id>",
+// "commit:<hash>", "branch:<name>", a bare run ID, or a bare (possibly
+// abbreviated) commit hash. A commit refers to the most recent run at that
+// commit, and a branch to the most recent run of that branch, of the
+// profile's project if it has one.
+func (env *Environment) resolveRun(ref string) (*run, error) {
+	kind, value := "", ref
+	if i := strings.Index(ref, ":"); i >= 0 {
+		kind, value = ref[:i], ref[i+1:]
+	}
+
+	switch kind {
+	case "run":
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid run ID %q", value)
+		}
+		return env.runByID(id)
+	case "commit":
+		return env.latestRunAtCommit(value)
+	case "branch":
+		return env.latestRunOnBranch(value)
+	case "":
+		// A bare number is tried as a run ID first, since abbreviated hashes
+		// are rarely all digits.
+		if id, err := strconv.ParseInt(value, 10, 64); err == nil {
+			r, err := env.runByID(id)
+			if err == nil {
+				return r, nil
+			}
+		}
+		return env.latestRunAtCommit(value)
+	default:
+		return nil, fmt.Errorf("unknown ref kind %q in %q", kind, ref)
+	}
+}
+
+// runByID returns the run with the given ID.
+func (env *Environment) runByID(id int64) (*run, error) {
+	r := &run{}
+	err := env.db.QueryRow("select id, commitHash, dateTime, coalesce(project, '') from runs where id = ?;", id).Scan(&r.id, &r.commitHash, &r.dateTime, &r.project)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w with ID %v", errNoRun, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// latestRunAtCommit returns the most recent run of the commit with the given
+// hash or hash prefix, of the profile's project if it has one.
+func (env *Environment) latestRunAtCommit(hash string) (*run, error) {
+	if err := checkCommitHash(hash); err != nil {
+		return nil, err
+	}
+	var project string
+	if env.profile != nil {
+		project = env.profile.Project
+	}
+	r := &run{}
+	err := env.db.QueryRow("select id, commitHash, dateTime, coalesce(project, '') from runs where commitHash like concat(?, '%') and "+projectFilter+" order by dateTime desc, id desc limit 1;", hash, project, project).Scan(&r.id, &r.commitHash, &r.dateTime, &r.project)
+	if err == sql.ErrNoRows {
+		if project != "" {
+			return nil, fmt.Errorf("%w found at commit %v of project %v", errNoRun, hash, project)
+		}
+		return nil, fmt.Errorf("%w found at commit %v", errNoRun, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// latestRunOnBranch returns the most recent run of the given branch, of the
+// profile's project if it has one.
+func (env *Environment) latestRunOnBranch(branch string) (*run, error) {
+	if branch == "" {
+		return nil, fmt.Errorf("empty branch")
+	}
+	var project string
+	if env.profile != nil {
+		project = env.profile.Project
+	}
+	r := &run{}
+	err := env.db.QueryRow("select id, commitHash, dateTime, coalesce(project, '') from runs where branch = ? and "+projectFilter+" order by dateTime desc, id desc limit 1;", branch, project, project).Scan(&r.id, &r.commitHash, &r.dateTime, &r.project)
+	if err == sql.ErrNoRows {
+		if project != "" {
+			return nil, fmt.Errorf("%w found on branch %v of project %v", errNoRun, branch, project)
+		}
+		return nil, fmt.Errorf("%w found on branch %v", errNoRun, branch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// runTestResults returns the results of every test stored for the given run.
+func (env *Environment) runTestResults(runID int64) ([]*TestResult, error) {
+	rows, err := env.db.Query("select name, packageName, result, output, duration from tests where runID = ?;", runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*TestResult
+	for rows.Next() {
+		var (
+			name     string
+			pkg      sql.NullString
+			status   string
+			output   sql.NullString
+			duration float64
+		)
+		if err := rows.Scan(&name, &pkg, &status, &output, &duration); err != nil {
+			return nil, err
+		}
+		result, err := ParseStatus(status)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, &TestResult{
+			name:     name,
+			pkg:      pkg.String,
+			result:   result,
+			output:   output.String,
+			duration: secondsToDuration(duration),
+		})
+	}
+	return results, rows.Err()
+}
+
+// runPackageResults returns the results of every package stored for the given
+// run.
+func (env *Environment) runPackageResults(runID int64) ([]*PackageResult, error) {
+	rows, err := env.db.Query("select name, result, duration from packages where runID = ?;", runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*PackageResult
+	for rows.Next() {
+		var (
+			name     string
+			status   string
+			duration float64
+		)
+		if err := rows.Scan(&name, &status, &duration); err != nil {
+			return nil, err
+		}
+		result, err := ParseStatus(status)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, &PackageResult{
+			name:     name,
+			result:   result,
+			duration: secondsToDuration(duration),
+		})
+	}
+	return results, rows.Err()
+}
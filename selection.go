@@ -0,0 +1,441 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// testStats summarize the stored passing and failing results of a test.
+type testStats struct {
+	pkg      string
+	name     string
+	runs     int
+	failures int
+
+	// duration is the mean duration of the test in seconds.
+	duration float64
+}
+
+// failureChance estimates how likely the test is to fail, from its history.
+// Tests with little history are given the benefit of the doubt.
+func (s *testStats) failureChance() float64 {
+	return float64(s.failures+1) / float64(s.runs+2)
+}
+
+// testStatsBefore returns the results of every top-level test of the
+// profile's project and branch within the window before the given time.
+// Subtests are left out, since they are run with their parents.
+func (env *Environment) testStatsBefore(window Window, before time.Time) ([]*testStats, error) {
+	rows, err := env.db.Query("select packageName, name, count(*), sum(result='FAILED'), avg(duration) from tests where packageName is not null and name != ? and name not like '%/%' and result in ('PASSED', 'FAILED') and dateTime >= date_sub(?, INTERVAL ? SECOND) and dateTime < ? and "+scopeFilter+" group by packageName, name;", append([]interface{}{panicTestName, before, window.Seconds(), before}, env.scopeArgs()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []*testStats
+	for rows.Next() {
+		s := &testStats{}
+		if err := rows.Scan(&s.pkg, &s.name, &s.runs, &s.failures, &s.duration); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// affectedPackages returns the import path of every package in the import
+// graph whose tests changes to the given files could affect, with how relevant
+// the changes are to it, from 0 to 1. Packages changed directly are the most
+// relevant, and those importing them, or whose tests import them, less so the
+// further away they are. A package whose tests import an affected package
+// doesn't affect the packages importing it in turn.
+func (g *importGraph) affectedPackages(changed []string) map[string]float64 {
+	importers := make(map[string][]string)
+	for p, imports := range g.imports {
+		for _, imp := range imports {
+			importers[imp] = append(importers[imp], p)
+		}
+	}
+	testImporters := make(map[string][]string)
+	for p, imports := range g.testImports {
+		for _, imp := range imports {
+			testImporters[imp] = append(testImporters[imp], p)
+		}
+	}
+
+	relevance := make(map[string]float64)
+	dist := make(map[string]int)
+	var queue []string
+	for _, f := range changed {
+		base := path.Base(f)
+		if base == "go.mod" || base == "go.sum" {
+			for _, p := range g.packages {
+				if relevance[p] < 0.25 {
+					relevance[p] = 0.25
+				}
+			}
+			continue
+		}
+		for d := path.Dir(f); ; d = path.Dir(d) {
+			if p, ok := g.packages[d]; ok {
+				if _, seen := dist[p]; !seen {
+					dist[p] = 0
+					queue = append(queue, p)
+				}
+				break
+			}
+			if d == "." {
+				break
+			}
+		}
+	}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, importer := range importers[p] {
+			if _, seen := dist[importer]; !seen {
+				dist[importer] = dist[p] + 1
+				queue = append(queue, importer)
+			}
+		}
+	}
+	// Tests importing an affected package are affected too, but nothing
+	// imports tests.
+	testDist := make(map[string]int)
+	for p, d := range dist {
+		for _, importer := range testImporters[p] {
+			if td, seen := testDist[importer]; !seen || d+1 < td {
+				testDist[importer] = d + 1
+			}
+		}
+	}
+	for p, d := range testDist {
+		if cur, seen := dist[p]; !seen || d < cur {
+			dist[p] = d
+		}
+	}
+	for p, d := range dist {
+		if r := 1 / float64(d+1); r > relevance[p] {
+			relevance[p] = r
+		}
+	}
+	return relevance
+}
+
+// packageSelection is the tests selected from one package. A selection with
+// no tests runs the whole package.
+type packageSelection struct {
+	importPath string
+	tests      []string
+	duration   float64
+	score      float64
+}
+
+// runPattern returns the -run regular expression selecting the tests.
+func (ps *packageSelection) runPattern() string {
+	if len(ps.tests) == 0 {
+		return "."
+	}
+	quoted := make([]string, len(ps.tests))
+	for i, t := range ps.tests {
+		quoted[i] = regexp.QuoteMeta(t)
+	}
+	return "^(" + strings.Join(quoted, "|") + ")$"
+}
+
+// selects reports whether the selection runs the named test.
+func (ps *packageSelection) selects(name string) bool {
+	if i := strings.Index(name, "/"); i >= 0 {
+		name = name[:i]
+	}
+	return len(ps.tests) == 0 || containsString(ps.tests, name)
+}
+
+// testSelection is a prioritised selection of the tests to run for a change.
+type testSelection struct {
+	packages []*packageSelection
+
+	// tests and duration are the number and estimated duration, in
+	// seconds, of the selected tests, and allTests and allDuration those of
+	// every test with stored results.
+	tests, allTests       int
+	duration, allDuration float64
+}
+
+// byImportPath returns the selection of the package with the given import
+// path, or nil.
+func (s *testSelection) byImportPath(importPath string) *packageSelection {
+	for _, ps := range s.packages {
+		if ps.importPath == importPath {
+			return ps
+		}
+	}
+	return nil
+}
+
+// selectTests picks the tests worth running for a change to the given files
+// within a time budget, or every affected test when budget is zero. Each test
+// of an affected package is scored by how relevant the change is to its
+// package and how often it failed, and tests are picked by score per second
+// of their mean duration until the budget is spent. Changed packages without
+// any stored results are run whole, since nothing is known about them.
+func selectTests(g *importGraph, changed []string, stats []*testStats, budget time.Duration) *testSelection {
+	relevance := g.affectedPackages(changed)
+	sel := &testSelection{}
+	importPaths := make(map[string]string)
+	withResults := make(map[string]bool)
+
+	type candidate struct {
+		*testStats
+		importPath string
+		score      float64
+	}
+	var candidates []candidate
+	for _, s := range stats {
+		sel.allTests++
+		sel.allDuration += s.duration
+		importPath, ok := importPaths[s.pkg]
+		if !ok {
+			importPath = g.lookup(s.pkg)
+			importPaths[s.pkg] = importPath
+		}
+		withResults[importPath] = true
+		if r := relevance[importPath]; r > 0 {
+			candidates = append(candidates, candidate{s, importPath, r * s.failureChance()})
+		}
+	}
+
+	for importPath, r := range relevance {
+		if r == 1 && !withResults[importPath] {
+			sel.packages = append(sel.packages, &packageSelection{importPath: importPath, score: r})
+		}
+	}
+
+	perSecond := func(c candidate) float64 { return c.score / (c.duration + 0.01) }
+	sort.Slice(candidates, func(i, j int) bool {
+		if perSecond(candidates[i]) != perSecond(candidates[j]) {
+			return perSecond(candidates[i]) > perSecond(candidates[j])
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	for _, c := range candidates {
+		if budget > 0 && sel.duration+c.duration > budget.Seconds() {
+			continue
+		}
+		ps := sel.byImportPath(c.importPath)
+		if ps == nil {
+			ps = &packageSelection{importPath: c.importPath}
+			sel.packages = append(sel.packages, ps)
+		}
+		ps.tests = append(ps.tests, c.name)
+		ps.duration += c.duration
+		if c.score > ps.score {
+			ps.score = c.score
+		}
+		sel.tests++
+		sel.duration += c.duration
+	}
+
+	for _, ps := range sel.packages {
+		sort.Strings(ps.tests)
+	}
+	sort.Slice(sel.packages, func(i, j int) bool {
+		if sel.packages[i].score != sel.packages[j].score {
+			return sel.packages[i].score > sel.packages[j].score
+		}
+		return sel.packages[i].importPath < sel.packages[j].importPath
+	})
+	return sel
+}
+
+// table returns the selection with a row for each package, most likely to
+// fail first.
+func (s *testSelection) table() *table {
+	t := &table{columns: []string{"package", "run", "tests", "duration", "score"}}
+	for _, ps := range s.packages {
+		t.rows = append(t.rows, []interface{}{ps.importPath, ps.runPattern(), int64(len(ps.tests)), ps.duration, ps.score})
+	}
+	return t
+}
+
+// replayRun is a stored run whose selection is evaluated by a replay.
+type replayRun struct {
+	run
+	previous string
+}
+
+// replayRuns returns every run of the profile's project and branch within the
+// window, oldest first, each with the commit of the run before it.
+func (env *Environment) replayRuns(window Window) ([]*replayRun, error) {
+	rows, err := env.db.Query("select r.id, r.commitHash, r.dateTime from runs r where r.dateTime >= date_sub(now(), INTERVAL ? SECOND) and "+runScopeFilter+" order by r.dateTime, r.id;", append([]interface{}{window.Seconds()}, env.scopeArgs()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []*replayRun
+	var previous string
+	for rows.Next() {
+		r := &replayRun{previous: previous}
+		if err := rows.Scan(&r.id, &r.commitHash, &r.dateTime); err != nil {
+			return nil, err
+		}
+		previous = r.commitHash
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// runFailures returns the package and name of every failed top-level test of
+// a run.
+func (env *Environment) runFailures(runID int64) ([][2]string, error) {
+	rows, err := env.db.Query("select coalesce(packageName, ''), name from tests where runID = ? and result = 'FAILED' and name not like '%/%';", runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures [][2]string
+	for rows.Next() {
+		var f [2]string
+		if err := rows.Scan(&f[0], &f[1]); err != nil {
+			return nil, err
+		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
+
+// replay evaluates test selection against the stored history: for each run
+// within the window that had failures, the tests that would have been
+// selected for the changes since the run before it, from the results stored
+// before it, are compared with the tests that failed. Runs at the same commit
+// as the run before them, or whose commits aren't in the checkout, are
+// skipped. It returns a row for each evaluated run, and the number of
+// failures and of those the selections caught.
+func (env *Environment) replay(repo string, g *importGraph, window Window, budget time.Duration) (*table, int, int, error) {
+	runs, err := env.replayRuns(window)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	t := &table{columns: []string{"runID", "commitHash", "changedFiles", "failures", "caught", "duration", "fullDuration"}}
+	var total, caught int
+	for _, r := range runs {
+		if r.previous == "" || r.previous == r.commitHash {
+			continue
+		}
+		failures, err := env.runFailures(r.id)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if len(failures) == 0 {
+			continue
+		}
+		files, _, err := changedFilesBetween(repo, r.previous, r.commitHash)
+		if err != nil {
+			log.Printf("Skipping run %d: %v", r.id, err)
+			continue
+		}
+		stats, err := env.testStatsBefore(window, r.dateTime)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		var changed []string
+		for _, f := range files {
+			changed = append(changed, f.path)
+		}
+		sel := selectTests(g, changed, stats, budget)
+
+		runCaught := 0
+		for _, f := range failures {
+			if ps := sel.byImportPath(g.lookup(f[0])); ps != nil && ps.selects(f[1]) {
+				runCaught++
+			}
+		}
+		total += len(failures)
+		caught += runCaught
+		t.rows = append(t.rows, []interface{}{r.id, r.commitHash, int64(len(changed)), int64(len(failures)), int64(runCaught), sel.duration, sel.allDuration})
+	}
+	return t, total, caught, nil
+}
+
+func init() {
+	commands["select"] = selectCommand
+}
+
+// selectCommand runs the "select" subcommand, which picks the tests worth
+// running for a change, or replays stored history to evaluate the picks.
+func selectCommand(args []string) {
+	fs := flag.NewFlagSet("select", flag.ExitOnError)
+	dbInfoPtr := fs.String("dbinfo", "db-info.txt", "file in which db information is contained")
+	repoPtr := fs.String("repo", ".", "git checkout of the code being tested")
+	basePtr := fs.String("base", "", "select for the changes made since this ref, e.g. origin/master, instead of the given files")
+	budgetPtr := fs.Duration("budget", 0, "time the selected tests may take, going by their mean durations, e.g. 10m (default no limit)")
+	windowPtr := fs.String("window", "30d", "how far back results are used")
+	projectPtr := fs.String("project", "", "only use results of this project")
+	branchPtr := fs.String("branch", "", "only use results of this branch")
+	replayPtr := fs.Bool("replay", false, "replay the runs within the window and report how many of their failures the selection would have caught")
+	formatPtr := fs.String("format", "table", "output format: table, csv or json")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s select [flags] [changed file]...\n\nPrints a -run pattern for each package worth testing for a change.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	window, err := ParseWindow(*windowPtr)
+	if err != nil {
+		log.Fatal("Error parsing window: ", err)
+	}
+	env := openEnvironment(*dbInfoPtr, &Profile{Name: "select", Window: window, Project: *projectPtr, Branch: *branchPtr})
+	defer env.db.Close()
+	g, err := loadImportGraph(*repoPtr)
+	if err != nil {
+		log.Fatal("Error listing packages: ", err)
+	}
+
+	if *replayPtr {
+		t, total, caught, err := env.replay(*repoPtr, g, window, *budgetPtr)
+		if err != nil {
+			log.Fatal("Error replaying history: ", err)
+		}
+		if err := t.write(os.Stdout, *formatPtr); err != nil {
+			log.Fatal(err)
+		}
+		if total > 0 {
+			fmt.Fprintf(os.Stderr, "Caught %d of %d failures (%.0f%%) in %d runs.\n", caught, total, 100*float64(caught)/float64(total), len(t.rows))
+		}
+		return
+	}
+
+	changed := fs.Args()
+	if *basePtr != "" {
+		files, _, err := changedFilesBetween(*repoPtr, *basePtr, "HEAD")
+		if err != nil {
+			log.Fatal("Error reading changes: ", err)
+		}
+		for _, f := range files {
+			changed = append(changed, f.path)
+		}
+	}
+	if len(changed) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	stats, err := env.testStatsBefore(window, time.Now())
+	if err != nil {
+		log.Fatal("Error selecting results: ", err)
+	}
+	sel := selectTests(g, changed, stats, *budgetPtr)
+	if err := sel.table().write(os.Stdout, *formatPtr); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Selected %d of %d tests, taking about %s of %s.\n", sel.tests, sel.allTests, formatSeconds(sel.duration), formatSeconds(sel.allDuration))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testGraph is a module in which a imports b, c imports d and cmd imports a,
+// and whose tests also import c from a and d from b.
+func testGraph() *importGraph {
+	return &importGraph{
+		packages: map[string]string{
+			"a":   "ex.com/m/a",
+			"b":   "ex.com/m/b",
+			"c":   "ex.com/m/c",
+			"d":   "ex.com/m/d",
+			"e":   "ex.com/m/e",
+			"cmd": "ex.com/m/cmd",
+		},
+		imports: map[string][]string{
+			"ex.com/m/a":   {"ex.com/m/b", "fmt"},
+			"ex.com/m/c":   {"ex.com/m/d"},
+			"ex.com/m/cmd": {"ex.com/m/a"},
+		},
+		testImports: map[string][]string{
+			"ex.com/m/a": {"ex.com/m/c", "testing"},
+			"ex.com/m/b": {"ex.com/m/d", "testing"},
+		},
+	}
+}
+
+func TestAffectedPackages(t *testing.T) {
+	g := testGraph()
+	for _, c := range []struct {
+		changed []string
+		want    map[string]float64
+	}{
+		{nil, map[string]float64{}},
+		{[]string{"README.md"}, map[string]float64{}},
+		// The tests of b import d, and those of a import c, which imports
+		// d; cmd only imports a, whose tests it doesn't run.
+		{[]string{"d/d.go"}, map[string]float64{
+			"ex.com/m/d": 1,
+			"ex.com/m/c": 0.5,
+			"ex.com/m/b": 0.5,
+			"ex.com/m/a": 1.0 / 3,
+		}},
+		// Files below a package's directory belong to it.
+		{[]string{"b/testdata/golden.txt"}, map[string]float64{
+			"ex.com/m/b":   1,
+			"ex.com/m/a":   0.5,
+			"ex.com/m/cmd": 1.0 / 3,
+		}},
+		// The closest change decides.
+		{[]string{"b/b.go", "a/a.go"}, map[string]float64{
+			"ex.com/m/b":   1,
+			"ex.com/m/a":   1,
+			"ex.com/m/cmd": 0.5,
+		}},
+		// Module files affect every package a little.
+		{[]string{"go.sum", "c/c.go"}, map[string]float64{
+			"ex.com/m/a":   0.5,
+			"ex.com/m/b":   0.25,
+			"ex.com/m/c":   1,
+			"ex.com/m/d":   0.25,
+			"ex.com/m/e":   0.25,
+			"ex.com/m/cmd": 0.25,
+		}},
+	} {
+		if got := g.affectedPackages(c.changed); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("affectedPackages(%q) = %v, want %v", c.changed, got, c.want)
+		}
+	}
+}
+
+func TestSelectTests(t *testing.T) {
+	g := testGraph()
+	stats := []*testStats{
+		{pkg: "d", name: "TestStable", runs: 10, failures: 0, duration: 1},
+		{pkg: "d", name: "TestFlaky", runs: 10, failures: 5, duration: 1},
+		{pkg: "c", name: "TestSlow", runs: 10, failures: 0, duration: 10},
+		{pkg: "cmd", name: "TestMain", runs: 10, failures: 9, duration: 1},
+	}
+	type pick struct {
+		importPath string
+		tests      []string
+	}
+	for _, c := range []struct {
+		changed []string
+		budget  time.Duration
+		want    []pick
+		tests   int
+	}{
+		// Every affected test is picked without a budget, most likely to
+		// fail first.
+		{[]string{"d/d.go"}, 0, []pick{
+			{"ex.com/m/d", []string{"TestFlaky", "TestStable"}},
+			{"ex.com/m/c", []string{"TestSlow"}},
+		}, 3},
+		// A budget picks by score per second until it is spent.
+		{[]string{"d/d.go"}, 2 * time.Second, []pick{
+			{"ex.com/m/d", []string{"TestFlaky", "TestStable"}},
+		}, 2},
+		{[]string{"d/d.go"}, time.Second, []pick{
+			{"ex.com/m/d", []string{"TestFlaky"}},
+		}, 1},
+		// A changed package without stored results is run whole.
+		{[]string{"e/e.go"}, 0, []pick{
+			{"ex.com/m/e", nil},
+		}, 0},
+		{[]string{"README.md"}, 0, nil, 0},
+	} {
+		sel := selectTests(g, c.changed, stats, c.budget)
+		var got []pick
+		for _, ps := range sel.packages {
+			got = append(got, pick{ps.importPath, ps.tests})
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("selectTests(%q, %v) = %v, want %v", c.changed, c.budget, got, c.want)
+		}
+		if sel.tests != c.tests || sel.allTests != len(stats) || sel.allDuration != 13 {
+			t.Errorf("selectTests(%q, %v) picked %d of %d tests taking %v, want %d of %d taking 13", c.changed, c.budget, sel.tests, sel.allTests, sel.allDuration, c.tests, len(stats))
+		}
+	}
+}
+
+func TestPackageSelectionRunPattern(t *testing.T) {
+	ps := &packageSelection{tests: []string{"TestA", "TestB.x"}}
+	if got, want := ps.runPattern(), `^(TestA|TestB\.x)$`; got != want {
+		t.Errorf("runPattern() = %q, want %q", got, want)
+	}
+	if !ps.selects("TestA/sub") || ps.selects("TestC") {
+		t.Error("selects doesn't match subtests of selected tests only")
+	}
+	if whole := (&packageSelection{}); whole.runPattern() != "." || !whole.selects("TestC") {
+		t.Error("a selection without tests doesn't run the whole package")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// apiPrefix is the path under which the versioned HTTP API is served.
+// Incompatible changes to the API are made under a new version.
+const apiPrefix = "/api/v1"
+
+// server serves the HTTP API and the dashboard. Analyses use the profiles in
+// cfg. When auth is set, every request must carry a token.
+type server struct {
+	env  *Environment
+	cfg  *Config
+	auth bool
+	mux  *http.ServeMux
+}
+
+// newServer returns a server for the given environment and config with every
+// route registered.
+func newServer(env *Environment, cfg *Config, auth bool) *server {
+	s := &server{env: env, cfg: cfg, auth: auth, mux: http.NewServeMux()}
+	s.mux.HandleFunc(apiPrefix+"/runs", s.handleRuns)
+	s.mux.HandleFunc(apiPrefix+"/runs/", s.handleRun)
+	s.mux.HandleFunc(apiPrefix+"/tests/", s.handleTest)
+	s.mux.HandleFunc(apiPrefix+"/clusters", s.handleClusters)
+	s.mux.HandleFunc(apiPrefix+"/flaky", s.handleFlaky)
+	s.mux.HandleFunc(apiPrefix+"/perf-diffs", s.handlePerfDiffs)
+	s.mux.HandleFunc(apiPrefix+"/audit", s.handleAudit)
+	s.mux.HandleFunc(apiPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "unknown resource %q", r.URL.Path)
+	})
+
+	s.mux.HandleFunc("/", s.handleDashboard)
+	s.mux.HandleFunc("/runs/", s.handleDashboardRun)
+	s.mux.HandleFunc("/tests/", s.handleDashboardTest)
+	s.mux.HandleFunc("/flaky", s.handleDashboardFlaky)
+	s.mux.HandleFunc("/panics", s.handleDashboardPanics)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.auth {
+		if r = s.authenticate(w, r); r == nil {
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// apiError is the body of every unsuccessful API response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes v as the JSON body of a response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		log.Print("Error writing response: ", err)
+	}
+}
+
+// writeError writes an error response with the given status.
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, apiError{Error: fmt.Sprintf(format, args...)})
+}
+
+// allowMethods writes an error response and returns false unless the request
+// uses one of the given methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	for _, m := range methods {
+		w.Header().Add("Allow", m)
+	}
+	writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	return false
+}
+
+func init() {
+	commands["serve"] = serveCommand
+}
+
+// serveCommand runs the "serve" subcommand, which serves the dashboard and the
+// HTTP API.
+func serveCommand(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	dbInfoPtr := fs.String("dbinfo", "db-info.txt", "file in which db information is contained")
+	addrPtr := fs.String("addr", ":8080", "address to listen on")
+	configPtr := fs.String("config", "", "JSON file containing report profiles")
+	noAuthPtr := fs.Bool("noauth", false, "serve without requiring API tokens, for trusted networks only")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve [flags]\n\nServes the dashboard, and the HTTP API under %s.\n\n", os.Args[0], apiPrefix)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(*configPtr)
+	if err != nil {
+		log.Fatal("Error loading config: ", err)
+	}
+	env := openEnvironment(*dbInfoPtr, nil)
+	defer env.db.Close()
+
+	srv := &http.Server{
+		Addr:              *addrPtr,
+		Handler:           newServer(env, cfg, !*noAuthPtr),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if *noAuthPtr {
+		log.Print("Serving without authentication: anyone who can connect may insert runs")
+	}
+	log.Printf("Serving on %v", *addrPtr)
+	log.Fatal(srv.ListenAndServe())
+}
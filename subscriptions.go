@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/marcinja/go-testdb/report"
+)
+
+// A Subscription sends a person or mailing list a digest of the update
+// covering only the packages and tests they care about.
+type Subscription struct {
+	Name string `json:"name"`
+
+	// To lists the email addresses the digest is sent to, such as
+	// "Alice <alice@example.com>" or a mailing list.
+	To []string `json:"to,omitempty"`
+
+	// Notifiers are other channels the digest is sent to.
+	Notifiers []*NotifierConfig `json:"notifiers,omitempty"`
+
+	// Packages lists packages to follow. A package ending in "/..." also
+	// matches every package below it.
+	Packages []string `json:"packages,omitempty"`
+
+	// Tests lists test name patterns to follow, such as "TestRenter*", in
+	// the syntax of path.Match.
+	Tests []string `json:"tests,omitempty"`
+
+	// Project, when set, is the project the digest is taken from instead of
+	// the profile's.
+	Project string `json:"project,omitempty"`
+}
+
+// validate checks that the subscription can be matched and delivered.
+func (s *Subscription) validate() error {
+	if len(s.To) == 0 && len(s.Notifiers) == 0 {
+		return fmt.Errorf("subscription %q has no recipients or notifiers", s.Name)
+	}
+	if len(s.Packages) == 0 && len(s.Tests) == 0 {
+		return fmt.Errorf("subscription %q has no packages or tests", s.Name)
+	}
+	for _, pattern := range s.Tests {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("subscription %q: bad test pattern %q", s.Name, pattern)
+		}
+	}
+	return nil
+}
+
+// matches reports whether a test or package is followed by the subscription.
+// Either name or pkg may be empty when it isn't known.
+func (s *Subscription) matches(name, pkg string) bool {
+	if pkg != "" {
+		for _, pattern := range s.Packages {
+			if matchPackage(pattern, pkg) {
+				return true
+			}
+		}
+	}
+	if name != "" {
+		for _, pattern := range s.Tests {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchPackage reports whether pkg is matched by pattern, which matches pkg
+// and everything below it when it ends in "/...", like the go tool.
+func matchPackage(pattern, pkg string) bool {
+	if !strings.HasSuffix(pattern, "/...") {
+		return pattern == pkg
+	}
+	prefix := strings.TrimSuffix(pattern, "/...")
+	return pkg == prefix || strings.HasPrefix(pkg, prefix+"/")
+}
+
+// digest returns a copy of the report holding only what the subscription
+// follows. Runs are kept as they are, for context.
+func (s *Subscription) digest(r *report.Report) *report.Report {
+	d := *r
+	d.Subscription = s.Name
+
+	d.Panics = nil
+	for _, p := range r.Panics {
+		if s.matches("", p.Package) {
+			d.Panics = append(d.Panics, p)
+		}
+	}
+	d.Failures = nil
+	for _, f := range r.Failures {
+		if s.matches(f.Name, f.Package) {
+			d.Failures = append(d.Failures, f)
+		}
+	}
+	d.Clusters = clusterFailures(d.Failures)
+	d.FailuresByOwner = groupFailuresByOwner(d.Failures)
+	d.Impacts = nil
+	for _, i := range r.Impacts {
+		if s.matches(i.Name, i.Package) {
+			d.Impacts = append(d.Impacts, i)
+		}
+	}
+	d.Flaky = nil
+	for _, f := range r.Flaky {
+		if s.matches(f.Name, f.Package) {
+			d.Flaky = append(d.Flaky, f)
+		}
+	}
+	d.PerfDiffs = nil
+	for _, p := range r.PerfDiffs {
+		if s.matches(p.Name, p.Package) {
+			d.PerfDiffs = append(d.PerfDiffs, p)
+		}
+	}
+
+	d.VanishedPackages = nil
+	for _, pkg := range r.VanishedPackages {
+		if s.matches("", pkg) {
+			d.VanishedPackages = append(d.VanishedPackages, pkg)
+		}
+	}
+	d.VanishedTests = s.matchingTests(r.VanishedTests)
+	d.NewTests = s.matchingTests(r.NewTests)
+	d.SkipJumps = nil
+	for _, j := range r.SkipJumps {
+		if s.matches(j.Name, j.Package) {
+			d.SkipJumps = append(d.SkipJumps, j)
+		}
+	}
+	return &d
+}
+
+// matchingTests returns the tests matched by the subscription.
+func (s *Subscription) matchingTests(tests []*report.InventoryTest) []*report.InventoryTest {
+	var matched []*report.InventoryTest
+	for _, t := range tests {
+		if s.matches(t.Name, t.Package) {
+			matched = append(matched, t)
+		}
+	}
+	return matched
+}
+
+// digestIsEmpty reports whether a digest has no failures, panics or
+// performance changes, in which case it isn't sent.
+func digestIsEmpty(d *report.Report) bool {
+	return len(d.Failures) == 0 && len(d.Panics) == 0 && len(d.PerfDiffs) == 0
+}
+
+// subscriptionNotifiers returns the notifiers a subscription's digest is sent
+// through. Its recipients are emailed through the profile's first SMTP
+// notifier if it has one, and through Gmail as with -email otherwise.
+func (env *Environment) subscriptionNotifiers(s *Subscription) ([]Notifier, error) {
+	var notifiers []Notifier
+	if len(s.To) > 0 {
+		var smtpConfig *NotifierConfig
+		for _, cfg := range env.profile.Notifiers {
+			if cfg.Type == "smtp" {
+				copied := *cfg
+				copied.To = s.To
+				smtpConfig = &copied
+				break
+			}
+		}
+		if smtpConfig == nil {
+			notifiers = append(notifiers, gmailNotifier(s.To))
+		} else {
+			n, err := newNotifier(smtpConfig)
+			if err != nil {
+				return nil, err
+			}
+			notifiers = append(notifiers, n)
+		}
+	}
+	for _, cfg := range s.Notifiers {
+		n, err := newNotifier(cfg)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/marcinja/go-testdb/report"
+)
+
+func TestDigestInventory(t *testing.T) {
+	r := &report.Report{
+		VanishedTests: []*report.InventoryTest{
+			{Name: "TestUpload", Package: "modules/renter"},
+			{Name: "TestUpload", Package: "modules/host"},
+		},
+		NewTests: []*report.InventoryTest{
+			{Name: "TestRenterFees", Package: "modules/wallet"},
+			{Name: "TestHostFees", Package: "modules/host"},
+		},
+		SkipJumps: []*report.SkipJump{
+			{Name: "TestProxy", Package: "modules/renter/proxy", RecentRate: 0.5},
+			{Name: "TestProxy", Package: "node", RecentRate: 0.5},
+		},
+	}
+	s := &Subscription{Name: "renter", Packages: []string{"modules/renter/..."}, Tests: []string{"TestRenter*"}}
+	d := s.digest(r)
+
+	if want := []*report.InventoryTest{r.VanishedTests[0]}; !reflect.DeepEqual(d.VanishedTests, want) {
+		t.Errorf("vanished tests = %v, want only the renter's TestUpload", d.VanishedTests)
+	}
+	if want := []*report.InventoryTest{r.NewTests[0]}; !reflect.DeepEqual(d.NewTests, want) {
+		t.Errorf("new tests = %v, want only TestRenterFees", d.NewTests)
+	}
+	if want := []*report.SkipJump{r.SkipJumps[0]}; !reflect.DeepEqual(d.SkipJumps, want) {
+		t.Errorf("skip jumps = %v, want only the renter's TestProxy", d.SkipJumps)
+	}
+}
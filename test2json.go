@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// testEvent is a line of `go test -json` output, as written by test2json.
+type testEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// test2jsonFraming are the prefixes of output lines written by the testing
+// package around a test's own output. They are left out of stored output, as
+// they are by ParseErrorLog.
+var test2jsonFraming = []string{"=== RUN", "=== PAUSE", "=== CONT", "=== NAME", "--- PASS", "--- FAIL", "--- SKIP"}
+
+// ParseTest2JSON parses `go test -json` output into a Result. The date time
+// is that of the first event; the output has no commit hash, so it must be
+// set by the caller. Lines that aren't JSON, such as build errors from older
+// versions of go, are ignored.
+func ParseTest2JSON(r io.Reader) (*Result, error) {
+	type testKey struct {
+		pkg, name string
+	}
+	var (
+		results  = &Result{}
+		tests    = make(map[testKey]*TestResult)
+		outputs  = make(map[testKey]*strings.Builder)
+		panicked = make(map[string]bool)
+	)
+	// A panic is recorded once for each package it occurs in.
+	notePanic := func(pkg, output string) {
+		if strings.HasPrefix(output, panicTest) && !panicked[pkg] {
+			panicked[pkg] = true
+			results.testResults = append(results.testResults, &TestResult{name: panicTestName, pkg: pkg, result: FAILED, output: output})
+		}
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; s.Scan(); line++ {
+		b := s.Bytes()
+		if len(b) == 0 || b[0] != '{' {
+			continue
+		}
+		var e testEvent
+		if err := json.Unmarshal(b, &e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if !e.Time.IsZero() && (results.dateTime.IsZero() || e.Time.Before(results.dateTime)) {
+			results.dateTime = e.Time
+		}
+		pkg := e.Package
+
+		if e.Test == "" {
+			switch e.Action {
+			case "output":
+				notePanic(pkg, e.Output)
+			case "pass", "fail", "skip":
+				status := Status(PASSED)
+				if e.Action == "fail" {
+					status = FAILED
+				} else if e.Action == "skip" {
+					status = SKIPPED
+				}
+				results.packageResults = append(results.packageResults, &PackageResult{
+					name:     pkg,
+					result:   status,
+					duration: secondsToDuration(e.Elapsed),
+				})
+			}
+			continue
+		}
+
+		key := testKey{pkg, e.Test}
+		t, ok := tests[key]
+		if !ok {
+			t = &TestResult{name: e.Test, pkg: pkg, result: UNDETERMINED}
+			tests[key] = t
+			outputs[key] = &strings.Builder{}
+			results.testResults = append(results.testResults, t)
+		}
+		switch e.Action {
+		case "output":
+			notePanic(pkg, e.Output)
+			if !isTest2JSONFraming(e.Output) {
+				outputs[key].WriteString(e.Output)
+			}
+		case "pass":
+			t.result = PASSED
+			t.duration = secondsToDuration(e.Elapsed)
+		case "fail":
+			t.result = FAILED
+			t.duration = secondsToDuration(e.Elapsed)
+			t.output = outputs[key].String()
+		case "skip":
+			t.result = SKIPPED
+			t.duration = secondsToDuration(e.Elapsed)
+			t.output = outputs[key].String()
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// isTest2JSONFraming reports whether an output line was written by the
+// testing package rather than the test.
+func isTest2JSONFraming(output string) bool {
+	trimmed := strings.TrimLeft(output, " ")
+	for _, prefix := range test2jsonFraming {
+		if strings.HasPrefix(trimmed, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,12 +4,12 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/mail"
 	"os"
-	"strconv"
+	"path"
 	"strings"
-
-	gomail "gopkg.in/gomail.v2"
 )
 
 /*
@@ -20,100 +20,178 @@ TODO: Find average durations concurrently
 
 TODO: Decide on proper way to output results.
 
-TODO: Send results in email, once daily.
-
 */
 
 type Environment struct {
-	db *sql.DB
+	db      *sql.DB
+	profile *Profile
 }
 
-var dbInfoFile string
-
 func main() {
+	// Subcommands have their own flags. Without one, the original flags are
+	// used to insert logs or produce the daily update.
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
 	dirPtr := flag.String("dir", "", "directory path")
 	filePtr := flag.String("file", "", "file path")
 	dbInfoPtr := flag.String("dbinfo", "db-info.txt", "file in which db information is contained")
 	updatePtr := flag.Bool("getUpdate", false, "receive an informed db update at the stated file path")
+	formatPtr := flag.String("format", "", "format of the update: text, html, json or yaml (default from the -file extension)")
 
 	emailPtr := flag.String("email", "", "the email that will recieve the update")
 	namePtr := flag.String("name", "", "the name of the person that will recieve the update email")
+	mf := addRunMetadataFlags(flag.CommandLine)
+	pf := addProfileFlags(flag.CommandLine)
 	flag.Parse()
 
-	dbInfoFile = *dbInfoPtr // Set directory for db info.
-	dbInfo := ReadFile(dbInfoFile)[0]
-	db, err := sql.Open("mysql",
-		dbInfo)
-	if err != nil {
-		panic(err)
+	profile := pf.load()
+	if *mf.project != "" {
+		pf.cfg.setProject(profile, *mf.project)
 	}
-	defer db.Close()
-	env := &Environment{
-		db,
+	if *mf.branch != "" {
+		profile.Branch = *mf.branch
 	}
+	if *mf.repo != "" {
+		profile.Repo = *mf.repo
+	}
+	env := openEnvironment(*dbInfoPtr, profile)
+	defer env.db.Close()
 
 	if *updatePtr {
 		if *filePtr != "" {
-			env.DailyUpdateToFile(*filePtr)
+			env.DailyUpdateToFile(*filePtr, *formatPtr)
+			return
+		}
+
+		// Without a file or recipient, a requested format goes to stdout so
+		// that other tools can read it.
+		if *emailPtr == "" && *namePtr == "" && *formatPtr != "" {
+			if err := env.writeDailyUpdate(os.Stdout, *formatPtr); err != nil {
+				log.Fatal("Error writing update: ", err)
+			}
 			return
 		}
 
 		if *emailPtr == "" && *namePtr == "" {
-			fmt.Printf("Run this command with the '-file FILENAME' flag, or with -email and -name flags.")
+			// Otherwise the update goes to the profile's notifiers and
+			// subscribers.
+			if len(env.profile.Notifiers) == 0 && len(env.profile.Subscriptions) == 0 {
+				fmt.Printf("Run this command with the '-file FILENAME' flag, with the '-format FORMAT' flag, with -email and -name flags, or with a profile that has notifiers or subscriptions.")
+				return
+			}
+			if err := env.notifyUpdate(); err != nil {
+				log.Fatal("Error sending update: ", err)
+			}
 			return
 		}
 
-		subj, body := env.DailyUpdate()
-		email(*emailPtr, *namePtr, subj, body)
+		if err := env.emailUpdate(*emailPtr, *namePtr); err != nil {
+			log.Fatal("Error emailing update: ", err)
+		}
 
 		return
 	}
 
+	meta := mf.load()
+	pf.cfg.applyProject(meta)
 	if *dirPtr != "" {
-		env.InsertLogsFromDirectory(*dirPtr)
+		env.InsertLogsFromDirectory(*dirPtr, meta)
 	} else if *filePtr != "" {
-		env.InsertLogToDB(*filePtr)
+		env.InsertLogToDB(*filePtr, meta)
 	} else {
 		fmt.Printf("No directory or file path given.")
 	}
 }
 
-// DailyUpdate gets panics, test failures, and performance changes from the last
-// day and outputs two strings fit for email subject and body that describe
-// these changes.
+// DailyUpdate gets panics, test failures, performance changes and changes in
+// which tests are run from the environment's profile window and outputs two
+// strings fit for email subject and body that describe these changes.
 func (env *Environment) DailyUpdate() (subject string, body string) {
-	diffs := env.performanceDiffsFromLastWeek()
-	failedTests := env.failedTestsFromLastDay()
-	panics := env.panicsFromLastDay()
-
-	body += "Found " + strconv.Itoa(len(panics)) + " panics in tests.\n"
-	for _, t := range panics {
-		body += "\n" + t.Format(referenceTime) + "\n"
+	rendered, err := env.renderDailyUpdate()
+	if err != nil {
+		log.Fatal("Error making update: ", err)
 	}
+	return rendered.subject, rendered.body
+}
 
-	body += "\nFound " + strconv.Itoa(len(failedTests)) + " tests that failed.\n"
-	for _, test := range failedTests {
-		body += "\n\tName: " + test.name + "\n"
-		body += "\tCommit Hash: " + test.commitHash + "\n"
-		body += "\tDatetime: " + test.dateTime.Format(referenceTime) + "\n"
-		body += "\tDuration: " + strings.TrimSuffix(test.duration.String(), "ns") + " seconds.\n"
-		body += "\tOutput: " + test.output + "\n"
+// renderDailyUpdate gathers the update for the environment's profile and
+// renders it through the profile's templates.
+func (env *Environment) renderDailyUpdate() (*renderedReport, error) {
+	rt, err := loadReportTemplates(env.profile.TextTemplate, env.profile.HTMLTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("loading update templates: %v", err)
 	}
+	r, err := env.gatherReport()
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := rt.render(r)
+	if err != nil {
+		return nil, fmt.Errorf("rendering update: %v", err)
+	}
+	return rendered, nil
+}
 
-	body += "\nFound " + strconv.Itoa(len(diffs)) + " tests whose performance changed by more than 20%.\n\n"
-	for _, diff := range diffs {
-		body += "\n\tName: " + diff.name + "\n"
-		body += "\tName: " + strconv.FormatFloat(diff.performanceChange, 'f', -1, 64) + "\n"
+// updateFormats are the formats the update can be written in.
+var updateFormats = []string{"text", "html", "json", "yaml"}
+
+// updateFormatForPath picks the update format from a file's extension,
+// falling back to plain text.
+func updateFormatForPath(filepath string) string {
+	switch strings.ToLower(path.Ext(filepath)) {
+	case ".html", ".htm":
+		return "html"
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	default:
+		return "text"
 	}
-	subject = "CI Update: Found " + strconv.Itoa(len(panics)) + " panics, " + strconv.Itoa(len(failedTests)) + " test failures, " + strconv.Itoa(len(diffs)) + " performance changes"
+}
 
-	return subject, body
+// writeDailyUpdate performs a DailyUpdate and writes it to w in the given
+// format: text, html, json or yaml.
+func (env *Environment) writeDailyUpdate(w io.Writer, format string) error {
+	switch format {
+	case "text", "html":
+		rendered, err := env.renderDailyUpdate()
+		if err != nil {
+			return err
+		}
+		if format == "html" {
+			_, err = io.WriteString(w, rendered.html)
+		} else {
+			_, err = io.WriteString(w, rendered.subject+"\n"+rendered.body)
+		}
+		return err
+	case "json", "yaml":
+		r, err := env.gatherReport()
+		if err != nil {
+			return err
+		}
+		if format == "yaml" {
+			return writeReportYAML(w, r)
+		}
+		return writeReportJSON(w, r)
+	default:
+		return fmt.Errorf("unknown update format %q, expected one of %v", format, strings.Join(updateFormats, ", "))
+	}
 }
 
 // DailyUpdateToFile performs a DailyUpdate and writes the result to a file at
-// the given path.
-func (env *Environment) DailyUpdateToFile(filepath string) {
-	subj, body := env.DailyUpdate()
+// the given path. If format is empty it is chosen from the path's extension:
+// ".html", ".json" and ".yaml" get those formats, and anything else plain
+// text.
+func (env *Environment) DailyUpdateToFile(filepath string, format string) {
+	if format == "" {
+		format = updateFormatForPath(filepath)
+	}
 
 	f, err := os.Create(filepath)
 	if err != nil {
@@ -121,26 +199,42 @@ func (env *Environment) DailyUpdateToFile(filepath string) {
 	}
 	defer f.Close()
 
-	f.WriteString(subj + "\n")
-	f.WriteString(body)
+	if err := env.writeDailyUpdate(f, format); err != nil {
+		log.Fatal("Error writing update: ", err)
+	}
 	f.Sync()
 	fmt.Printf("Daily update written to file succesfully.")
 }
 
-// email sends an email to the recipient email with the recipient name, subject,
-// and body.
-func email(recipientEmail, recipientName, subject, body string) error {
-	emailAddr := os.Getenv("EMAIL_ADDR")
-	emailPw := os.Getenv("EMAIL_PW")
-	s, err := gomail.NewDialer("smtp.gmail.com", 587, emailAddr, emailPw).Dial()
+// emailUpdate performs a DailyUpdate and emails it to the recipient as a
+// multipart message with plain text and HTML versions.
+func (env *Environment) emailUpdate(recipientEmail, recipientName string) error {
+	rendered, err := env.renderDailyUpdate()
 	if err != nil {
 		return err
 	}
+	return email(recipientEmail, recipientName, rendered.subject, rendered.body, rendered.html)
+}
 
-	m := gomail.NewMessage()
-	m.SetHeader("From", emailAddr)
-	m.SetAddressHeader("To", recipientEmail, recipientName)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/plain", body)
-	return gomail.Send(s, m)
+// email sends an email to the recipient email with the recipient name, subject,
+// and body. If htmlBody is not empty it is sent as an alternative to the plain
+// text body.
+func email(recipientEmail, recipientName, subject, body, htmlBody string) error {
+	to := (&mail.Address{Name: recipientName, Address: recipientEmail}).String()
+	return gmailNotifier([]string{to}).Notify(&renderedReport{subject: subject, body: body, html: htmlBody})
+}
+
+// gmailNotifier returns a notifier that emails the given recipients through
+// Gmail, using the credentials in EMAIL_ADDR and EMAIL_PW.
+func gmailNotifier(to []string) Notifier {
+	emailAddr := os.Getenv("EMAIL_ADDR")
+	return &smtpNotifier{
+		host:     "smtp.gmail.com",
+		port:     587,
+		tls:      smtpStartTLS,
+		username: emailAddr,
+		password: os.Getenv("EMAIL_PW"),
+		from:     emailAddr,
+		to:       to,
+	}
 }
@@ -1,6 +1,10 @@
 package main
 
-import "time"
+import (
+	"fmt"
+	"sort"
+	"time"
+)
 
 type Status int
 
@@ -13,6 +17,24 @@ const (
 
 var StatusStrings = [...]string{"PASSED", "SKIPPED", "FAILED", "UNDETERMINED"}
 
+// String returns the name MySql uses for the status in its enum.
+func (s Status) String() string {
+	if int(s) < 0 || int(s) >= len(StatusStrings) {
+		return "Status(" + fmt.Sprint(int(s)) + ")"
+	}
+	return StatusStrings[int(s)]
+}
+
+// ParseStatus returns the status with the given name, as stored by MySql.
+func ParseStatus(name string) (Status, error) {
+	for i, s := range StatusStrings {
+		if s == name {
+			return Status(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown status %q", name)
+}
+
 type Result struct {
 	commitHash     string
 	dateTime       time.Time
@@ -20,6 +42,12 @@ type Result struct {
 	packageResults []*PackageResult
 }
 
+// secondsToDuration converts a duration stored in the database as a number of
+// seconds to a time.Duration.
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
 // PackageResult stores information about the tests of a single package.
 type PackageResult struct {
 	name     string
@@ -30,7 +58,27 @@ type PackageResult struct {
 // TestResult represents the information given from a single test completing.
 type TestResult struct {
 	name     string
+	pkg      string
 	result   Status
 	output   string
 	duration time.Duration
 }
+
+// testID identifies a test by its package and name, since tests of different
+// packages may share a name.
+type testID struct {
+	pkg, name string
+}
+
+// less orders tests by name, then package.
+func (t testID) less(u testID) bool {
+	if t.name != u.name {
+		return t.name < u.name
+	}
+	return t.pkg < u.pkg
+}
+
+// sortTestIDs sorts tests by name, then package.
+func sortTestIDs(tests []testID) {
+	sort.Slice(tests, func(i, j int) bool { return tests[i].less(tests[j]) })
+}
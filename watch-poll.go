@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// watchDirs returns no change notifications on systems without inotify, so
+// the watcher polls instead.
+func watchDirs(dirs []string) (<-chan struct{}, func(), error) {
+	return nil, nil, nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchSafetyPoll is how often directories are scanned when change
+// notifications are available, in case one was missed.
+const watchSafetyPoll = time.Minute
+
+// pendingFile is a log file that hasn't been ingested yet, as last seen.
+type pendingFile struct {
+	size        int64
+	modTime     time.Time
+	stableSince time.Time
+}
+
+// logWatcher ingests log files that appear in a set of directories. A file is
+// ingested once it has stopped changing for settle, and is then recorded in
+// the ingestedFiles table so that it is never ingested again.
+type logWatcher struct {
+	env      *Environment
+	dirs     []string
+	meta     *runMetadata
+	settle   time.Duration
+	interval time.Duration
+
+	// pattern, when set, selects the files to ingest by name instead of
+	// isLogFileName.
+	pattern string
+
+	ingested map[string]bool
+	pending  map[string]*pendingFile
+
+	// failed holds files that couldn't be parsed, as they were when they
+	// failed, so that they are only retried if they change.
+	failed map[string]pendingFile
+}
+
+// isLogFileName reports whether a file name is one the watcher ingests by
+// default: a text log named like the archives of run-tests, or a test2json or
+// JUnit log.
+func isLogFileName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".xml":
+		return true
+	case ".log":
+		return strings.HasPrefix(name, "error-")
+	}
+	return false
+}
+
+// wants reports whether the watcher ingests files with the given name.
+func (w *logWatcher) wants(name string) bool {
+	// Hidden files are usually still being written by an editor or a copy.
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	if w.pattern != "" {
+		ok, _ := filepath.Match(w.pattern, name)
+		return ok
+	}
+	return isLogFileName(name)
+}
+
+// ingestedFiles returns the paths of every file recorded as ingested.
+func (env *Environment) ingestedFiles() (map[string]bool, error) {
+	rows, err := env.db.Query("select path from ingestedFiles;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make(map[string]bool)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		files[path] = true
+	}
+	return files, rows.Err()
+}
+
+// recordIngestedFile records that the file at path was inserted as the given
+// run.
+func (env *Environment) recordIngestedFile(path string, runID int64) error {
+	_, err := env.db.Exec("INSERT ingestedFiles SET path=?,runID=?,ingestedAt=?", path, runID, time.Now())
+	return err
+}
+
+// scan looks for new and changed files and ingests those that have settled.
+func (w *logWatcher) scan() {
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, dir := range w.dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Printf("Error reading %v: %v", dir, err)
+			continue
+		}
+		for _, f := range files {
+			if !f.Mode().IsRegular() || !w.wants(f.Name()) {
+				continue
+			}
+			path := filepath.Join(dir, f.Name())
+			if w.ingested[path] {
+				continue
+			}
+			seen[path] = true
+			if failed, ok := w.failed[path]; ok {
+				if failed.size == f.Size() && failed.modTime.Equal(f.ModTime()) {
+					continue
+				}
+				delete(w.failed, path)
+			}
+
+			p, ok := w.pending[path]
+			if !ok || p.size != f.Size() || !p.modTime.Equal(f.ModTime()) {
+				w.pending[path] = &pendingFile{size: f.Size(), modTime: f.ModTime(), stableSince: now}
+				continue
+			}
+			if now.Sub(p.stableSince) >= w.settle {
+				w.ingest(path, p)
+			}
+		}
+	}
+	// Forget files that were removed before they settled.
+	for path := range w.pending {
+		if !seen[path] {
+			delete(w.pending, path)
+		}
+	}
+}
+
+// ingest inserts the settled file at path and records it. A file that can't
+// be parsed waits until it changes, while one that can't be inserted or
+// recorded, usually because the database is unreachable, is tried again once
+// it has settled for another settle.
+func (w *logWatcher) ingest(path string, p *pendingFile) {
+	results, err := parseLogFile(path, w.meta)
+	if err != nil {
+		log.Printf("Error parsing %v: %v", path, err)
+		delete(w.pending, path)
+		w.failed[path] = *p
+		return
+	}
+	runID, err := w.env.insertResult(results, w.meta)
+	if err != nil {
+		log.Printf("Error inserting %v, retrying: %v", path, err)
+		p.stableSince = time.Now()
+		return
+	}
+	// A run whose file isn't recorded would be inserted again after a
+	// restart, so it is taken back out.
+	if err := w.env.recordIngestedFile(path, runID); err != nil {
+		log.Printf("Error recording %v as ingested: %v", path, err)
+		if err := w.env.deleteRun(runID, results.dateTime); err != nil {
+			log.Printf("Error deleting run %d of %v: %v", runID, path, err)
+		}
+		p.stableSince = time.Now()
+		return
+	}
+	delete(w.pending, path)
+	w.ingested[path] = true
+	log.Printf("Inserted %v as run %d", path, runID)
+}
+
+// run scans the directories until a signal arrives on stop. Change
+// notifications, where available, trigger a scan straight away; otherwise
+// the directories are polled every interval.
+func (w *logWatcher) run(stop <-chan os.Signal) {
+	events, closeEvents, err := watchDirs(w.dirs)
+	if err != nil {
+		// Notifications can run out, e.g. at the inotify watch limit,
+		// which polling does without.
+		log.Printf("Error watching for changes, polling every %v instead: %v", w.interval, err)
+		events, closeEvents = nil, nil
+	}
+	if closeEvents != nil {
+		defer closeEvents()
+	}
+
+	for {
+		w.scan()
+
+		wait := w.interval
+		if events != nil {
+			wait = watchSafetyPoll
+		}
+		// Files waiting to settle are checked again once they might have.
+		if len(w.pending) > 0 && w.settle < wait {
+			wait = w.settle
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-events:
+			timer.Stop()
+		case sig := <-stop:
+			timer.Stop()
+			log.Printf("Received %v, stopping", sig)
+			return
+		}
+	}
+}
+
+func init() {
+	commands["watch"] = watchCommand
+}
+
+// watchCommand runs the "watch" subcommand, which ingests new logs as they
+// appear in one or more directories.
+func watchCommand(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	dbInfoPtr := fs.String("dbinfo", "db-info.txt", "file in which db information is contained")
+	settlePtr := fs.Duration("settle", 10*time.Second, "how long a file must stop changing before it is ingested")
+	intervalPtr := fs.Duration("interval", 5*time.Second, "how often to poll when change notifications aren't available")
+	configPtr := fs.String("config", "", "JSON file containing project settings")
+	patternPtr := fs.String("pattern", "", "ingest only files whose names match this pattern, such as \"*.log\" (default error-*.log, *.json and *.xml)")
+	mf := addRunMetadataFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s watch [flags] <dir>...\n\nIngests logs as they appear in the given directories.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if _, err := filepath.Match(*patternPtr, ""); err != nil {
+		log.Fatalf("Bad pattern %q: %v", *patternPtr, err)
+	}
+
+	var dirs []string
+	for _, dir := range fs.Args() {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dirs = append(dirs, abs)
+	}
+
+	cfg, err := LoadConfig(*configPtr)
+	if err != nil {
+		log.Fatal("Error loading config: ", err)
+	}
+	meta := mf.load()
+	cfg.applyProject(meta)
+
+	env := openEnvironment(*dbInfoPtr, nil)
+	defer env.db.Close()
+	ingested, err := env.ingestedFiles()
+	if err != nil {
+		log.Fatal("Error selecting ingested files: ", err)
+	}
+
+	w := &logWatcher{
+		env:      env,
+		dirs:     dirs,
+		meta:     meta,
+		settle:   *settlePtr,
+		interval: *intervalPtr,
+		pattern:  *patternPtr,
+		ingested: ingested,
+		pending:  make(map[string]*pendingFile),
+		failed:   make(map[string]pendingFile),
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	w.run(stop)
+}